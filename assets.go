@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The pages, templates and resources are built into the binary
+// so it can be started from any directory.
+//
+//go:embed public/*.html public/res
+var embeddedPublic embed.FS
+
+// overlayFS looks for files in override first and falls back to base,
+// so a theme only needs to contain the files it changes
+type overlayFS struct {
+	override fs.FS
+	base     fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.override.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return o.base.Open(name)
+}
+
+// newPublicFS returns the filesystem pages are served from.
+// If overrideDir is set, files in it take precedence over the built in ones.
+func newPublicFS(overrideDir string) (fs.FS, error) {
+	base, err := fs.Sub(embeddedPublic, "public")
+	if err != nil {
+		return nil, err
+	}
+	if overrideDir == "" {
+		return base, nil
+	}
+
+	info, err := os.Stat(overrideDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New(overrideDir + " is not a directory")
+	}
+	return overlayFS{override: os.DirFS(overrideDir), base: base}, nil
+}
+
+// etagCache remembers the ETag of each file served, so it is only hashed again when it changes.
+// Embedded files have no modification time and never change, so they are hashed once.
+type etagCache struct {
+	mu    sync.Mutex
+	files map[string]etagEntry
+}
+
+type etagEntry struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{files: make(map[string]etagEntry)}
+}
+
+// etag returns the ETag of the file name, reading it from content if it changed since last time.
+// content is left at its start.
+func (c *etagCache) etag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.files[name]
+	c.mu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.etag, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	entry = etagEntry{modTime: info.ModTime(), size: info.Size(), etag: `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`}
+	c.mu.Lock()
+	c.files[name] = entry
+	c.mu.Unlock()
+	return entry.etag, nil
+}
+
+// serveAsset writes a file from fsys with an ETag so browsers can revalidate it cheaply
+func serveAsset(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string, cacheControl string, etags *etagCache) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Both embedded and os files can seek, anything else is read into memory
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, "unable to read file", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	etag, err := etags.etag(name, info, content)
+	if err != nil {
+		http.Error(w, "unable to read file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+
+	// Embedded files have no modification time, in which case
+	// ServeContent leaves out Last-Modified and relies on the ETag
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// ResourceHandler serves everything under /res/ from fsys.
+// Resources rarely change during a battle so browsers may cache them for an hour.
+func ResourceHandler(fsys fs.FS) http.Handler {
+	etags := newETagCache()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		serveAsset(w, r, fsys, path.Join("res", name), "public, max-age=3600", etags)
+	})
+}
+
+// imageTypes are the files ImageHandler will serve
+var imageTypes = map[string]bool{".png": true, ".gif": true, ".jpg": true, ".jpeg": true, ".webp": true}
+
+// ImageHandler serves candidate images under /img/ from fsys.
+// Only image files are served, since the image directory may hold other things too.
+func ImageHandler(fsys fs.FS) http.Handler {
+	etags := newETagCache()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if !imageTypes[strings.ToLower(path.Ext(name))] {
+			http.NotFound(w, r)
+			return
+		}
+		serveAsset(w, r, fsys, name, "public, max-age=3600", etags)
+	})
+}
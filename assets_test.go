@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublicFSOverride(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "home.html"), []byte("themed home"), 0644)
+
+	fsys, err := newPublicFS(dir)
+	if err != nil {
+		t.Fatalf("Couldn't create public FS: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	serveAsset(rec, httptest.NewRequest("GET", "/", nil), fsys, "home.html", "no-cache", newETagCache())
+	if rec.Body.String() != "themed home" {
+		t.Errorf("Expected the themed home page, got %q", rec.Body.String())
+	}
+
+	// Anything not in the theme comes from the binary
+	rec = httptest.NewRecorder()
+	ResourceHandler(fsys).ServeHTTP(rec, httptest.NewRequest("GET", "/main.css", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "gridwrapper") {
+		t.Errorf("Expected the built in main.css, got %d", rec.Code)
+	}
+
+	if _, err := newPublicFS(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected a missing override directory to be an error")
+	}
+}
+
+func TestResourceETag(t *testing.T) {
+	fsys, _ := newPublicFS("")
+
+	rec := httptest.NewRecorder()
+	ResourceHandler(fsys).ServeHTTP(rec, httptest.NewRequest("GET", "/main.css", nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected main.css with an ETag, got %d %q", rec.Code, etag)
+	}
+	if rec.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("Unexpected Cache-Control %q", rec.Header().Get("Cache-Control"))
+	}
+
+	req := httptest.NewRequest("GET", "/main.css", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	ResourceHandler(fsys).ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	ResourceHandler(fsys).ServeHTTP(rec, httptest.NewRequest("GET", "/../vote_during.html", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected files outside res/ to be hidden, got %d", rec.Code)
+	}
+}
+
+func TestImageHandler(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "battle"), 0755)
+	os.WriteFile(filepath.Join(dir, "battle", "1234.gif"), []byte("GIF89a"), 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("secret"), 0644)
+
+	/* each row takes the form:
+	{path, expected status}
+	*/
+	testData := []struct {
+		path   string
+		status int
+	}{
+		{"/battle/1234.gif", http.StatusOK},
+		{"/battle/5678.png", http.StatusNotFound},
+		{"/notes.txt", http.StatusNotFound},
+		{"/../battle/1234.gif", http.StatusOK},
+	}
+
+	for i, d := range testData {
+		rec := httptest.NewRecorder()
+		ImageHandler(os.DirFS(dir)).ServeHTTP(rec, httptest.NewRequest("GET", d.path, nil))
+		if rec.Code != d.status {
+			t.Errorf("Test[%d] expected %d, got %d", i, d.status, rec.Code)
+		}
+	}
+}
+
+func TestImageETagChanges(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "1234.gif")
+	os.WriteFile(file, []byte("GIF89a"), 0644)
+	handler := ImageHandler(os.DirFS(dir))
+
+	get := func() string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/1234.gif", nil))
+		return rec.Header().Get("ETag")
+	}
+
+	first := get()
+	if again := get(); again != first {
+		t.Errorf("Expected the same ETag for the same file, got %q then %q", first, again)
+	}
+
+	// A re-imported emoji replaces the file, which the ETag has to follow
+	os.WriteFile(file, []byte("GIF89a!"), 0644)
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+	if changed := get(); changed == first {
+		t.Errorf("Expected a new ETag after the file changed, still %q", changed)
+	}
+}
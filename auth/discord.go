@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/i18n"
+	"Emoji-battle-royale/logging"
+
+	"golang.org/x/oauth2"
+)
+
+// Default Discord endpoints, used when they aren't set in the config
+const (
+	defaultAuthURL  = "https://discord.com/api/oauth2/authorize"
+	defaultTokenURL = "https://discord.com/api/oauth2/token"
+	defaultAPIURL   = "https://discord.com/api"
+)
+
+const stateCookieName = "ebr_oauth_state"
+
+// DiscordUser is the part of the Discord user object we care about
+type DiscordUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+type discordGuild struct {
+	ID string `json:"id"`
+}
+
+// DiscordLogin runs the Discord OAuth2 login flow and starts a session for guild members
+type DiscordLogin struct {
+	oauth    *oauth2.Config
+	apiURL   string
+	guildID  string
+	sessions *Sessions
+	locales  *i18n.Bundle
+}
+
+// NewDiscordLogin creates a login flow from the OAuth section of the config.
+// Errors are shown to the user in their language from locales.
+func NewDiscordLogin(conf config.Config, sessions *Sessions, locales *i18n.Bundle) *DiscordLogin {
+	authURL, tokenURL, apiURL := conf.OAuth.AuthURL, conf.OAuth.TokenURL, conf.OAuth.APIURL
+	if authURL == "" {
+		authURL = defaultAuthURL
+	}
+	if tokenURL == "" {
+		tokenURL = defaultTokenURL
+	}
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+
+	return &DiscordLogin{
+		oauth: &oauth2.Config{
+			ClientID:     conf.OAuth.ClientID,
+			ClientSecret: conf.OAuth.ClientSecret,
+			RedirectURL:  conf.OAuth.RedirectURL,
+			Scopes:       []string{"identify", "guilds"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   authURL,
+				TokenURL:  tokenURL,
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+		apiURL:   apiURL,
+		guildID:  conf.GuildID,
+		sessions: sessions,
+		locales:  locales,
+	}
+}
+
+// LoginHandler redirects the user to Discord to authorize the app
+func (d *DiscordLogin) LoginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			writeError(w, r, d.locales, "login.error", http.StatusInternalServerError)
+			return
+		}
+		state := base64.RawURLEncoding.EncodeToString(b)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     stateCookieName,
+			Value:    state,
+			Path:     "/",
+			MaxAge:   int((10 * time.Minute).Seconds()),
+			HttpOnly: true,
+			Secure:   d.sessions.secure(r),
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, d.oauth.AuthCodeURL(state), http.StatusFound)
+	})
+}
+
+// CallbackHandler finishes the login once Discord redirects back to us.
+// Only members of the configured guild are given a session.
+func (d *DiscordLogin) CallbackHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stateCookie, err := r.Cookie(stateCookieName)
+		if err != nil || stateCookie.Value == "" || stateCookie.Value != r.URL.Query().Get("state") {
+			writeError(w, r, d.locales, "login.invalid_state", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: stateCookieName, Path: "/", MaxAge: -1, Secure: d.sessions.secure(r)})
+
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			writeError(w, r, d.locales, "login.not_authorized", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := d.oauth.Exchange(r.Context(), code)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Unable to exchange OAuth code", "error", err)
+			writeError(w, r, d.locales, "login.discord_error", http.StatusBadGateway)
+			return
+		}
+		client := d.oauth.Client(r.Context(), token)
+
+		user, err := d.fetchUser(r.Context(), client)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Unable to fetch Discord user", "error", err)
+			writeError(w, r, d.locales, "login.discord_error", http.StatusBadGateway)
+			return
+		}
+
+		member, err := d.isGuildMember(r.Context(), client)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Unable to fetch Discord guilds", "user", user.ID, "error", err)
+			writeError(w, r, d.locales, "login.discord_error", http.StatusBadGateway)
+			return
+		}
+		if !member {
+			writeError(w, r, d.locales, "login.not_member", http.StatusForbidden)
+			return
+		}
+
+		d.sessions.SetUser(w, r, user.ID)
+		http.Redirect(w, r, "/vote", http.StatusFound)
+	})
+}
+
+// LogoutHandler ends the session
+func (d *DiscordLogin) LogoutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.sessions.Clear(w, r)
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+}
+
+// getJSON fetches path from the Discord API and decodes the response into v
+func (d *DiscordLogin) getJSON(ctx context.Context, client *http.Client, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (d *DiscordLogin) fetchUser(ctx context.Context, client *http.Client) (DiscordUser, error) {
+	var user DiscordUser
+	if err := d.getJSON(ctx, client, "/users/@me", &user); err != nil {
+		return user, err
+	}
+	if user.ID == "" {
+		return user, fmt.Errorf("Discord returned a user without an ID")
+	}
+	return user, nil
+}
+
+func (d *DiscordLogin) isGuildMember(ctx context.Context, client *http.Client) (bool, error) {
+	var guilds []discordGuild
+	if err := d.getJSON(ctx, client, "/users/@me/guilds", &guilds); err != nil {
+		return false, err
+	}
+	for _, g := range guilds {
+		if g.ID == d.guildID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
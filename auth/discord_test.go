@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"Emoji-battle-royale/config"
+)
+
+// fakeDiscord stands in for Discord's OAuth and API endpoints
+func fakeDiscord(t *testing.T, guilds []string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "goodcode" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"tok","token_type":"Bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/api/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":"80351110224678912","username":"Nelly"}`))
+	})
+	mux.HandleFunc("/api/users/@me/guilds", func(w http.ResponseWriter, r *http.Request) {
+		var list []discordGuild
+		for _, g := range guilds {
+			list = append(list, discordGuild{ID: g})
+		}
+		json.NewEncoder(w).Encode(list)
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestLogin(t *testing.T, provider *httptest.Server) (*DiscordLogin, *Sessions) {
+	sessions, err := NewSessions([]string{"0123456789abcdef0123"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Couldn't create sessions: %v", err)
+	}
+
+	conf := config.Config{
+		GuildID: "152893724500819969",
+		OAuth: config.OAuthConfig{
+			ClientID:     "client",
+			ClientSecret: "secret",
+			RedirectURL:  "http://localhost/login/callback",
+			AuthURL:      provider.URL + "/oauth2/authorize",
+			TokenURL:     provider.URL + "/oauth2/token",
+			APIURL:       provider.URL + "/api",
+		},
+	}
+	return NewDiscordLogin(conf, sessions, testLocales(t)), sessions
+}
+
+// login runs the login and callback handlers and returns the callback response
+func login(t *testing.T, d *DiscordLogin, code string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	d.LoginHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected login to redirect, got %d", rec.Code)
+	}
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	state := loc.Query().Get("state")
+
+	req := httptest.NewRequest("GET", "/login/callback?code="+code+"&state="+state, nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	d.CallbackHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDiscordLoginMember(t *testing.T) {
+	provider := fakeDiscord(t, []string{"1", "152893724500819969"})
+	defer provider.Close()
+	d, sessions := newTestLogin(t, provider)
+
+	rec := login(t, d, "goodcode")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected callback to redirect, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	userID, err := sessions.UserID(requestWith(rec))
+	if err != nil {
+		t.Fatalf("Expected a session after login: %v", err)
+	}
+	if userID != "80351110224678912" {
+		t.Errorf("Expected session for 80351110224678912, got %s", userID)
+	}
+}
+
+func TestDiscordLoginRejected(t *testing.T) {
+	provider := fakeDiscord(t, []string{"1", "2"})
+	defer provider.Close()
+	d, _ := newTestLogin(t, provider)
+
+	if rec := login(t, d, "goodcode"); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "only members of the server") {
+		t.Errorf("Expected non-member to get 403, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := login(t, d, "badcode"); rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected bad code to get 502, got %d", rec.Code)
+	}
+
+	rec := httptest.NewRecorder()
+	d.CallbackHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/login/callback?code=goodcode&state=forged", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected missing state cookie to get 400, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoSession is returned when a request doesn't carry a valid session cookie
+var ErrNoSession = errors.New("no valid session")
+
+// errBadSignature is returned by verify for anything that wasn't signed by one of our keys
+var errBadSignature = errors.New("invalid or expired signature")
+
+const sessionCookieName = "ebr_session"
+
+// Sessions issues and verifies HMAC signed session cookies.
+/* A signed value takes the form:
+base64(field1).base64(field2)...expiry.base64(signature)
+where the signature covers everything before it. Nothing is stored server side.
+
+The first key signs new values. All keys are accepted when verifying,
+so a new key can be put in front of the list and the old one removed
+once every session signed with it has expired.
+*/
+type Sessions struct {
+	keys   [][]byte
+	maxAge time.Duration
+
+	// Secure marks every cookie as HTTPS only. Set it when the server has TLS on;
+	// cookies set in answer to a request which came in over HTTPS are marked anyway.
+	Secure bool
+}
+
+// NewSessions creates a session manager which signs cookies with keys[0]
+func NewSessions(keys []string, maxAge time.Duration) (*Sessions, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one session key is required")
+	}
+	s := &Sessions{maxAge: maxAge}
+	for i, k := range keys {
+		if len(k) < 16 {
+			return nil, fmt.Errorf("session key %d must be at least 16 characters", i)
+		}
+		s.keys = append(s.keys, []byte(k))
+	}
+	return s, nil
+}
+
+func mac(key []byte, payload string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+// sign creates a value holding fields which expires at the given time
+func (s *Sessions) sign(expires time.Time, fields ...string) string {
+	var parts []string
+	for _, f := range fields {
+		parts = append(parts, base64.RawURLEncoding.EncodeToString([]byte(f)))
+	}
+	payload := strings.Join(append(parts, strconv.FormatInt(expires.Unix(), 10)), ".")
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac(s.keys[0], payload))
+}
+
+// verify checks a value created by sign and returns its fields
+func (s *Sessions) verify(value string) ([]string, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return nil, errBadSignature
+	}
+	payload := value[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return nil, errBadSignature
+	}
+
+	valid := false
+	for _, k := range s.keys {
+		if hmac.Equal(sig, mac(k, payload)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, errBadSignature
+	}
+
+	parts := strings.Split(payload, ".")
+	expires, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, errBadSignature
+	}
+
+	var fields []string
+	for _, p := range parts[:len(parts)-1] {
+		f, err := base64.RawURLEncoding.DecodeString(p)
+		if err != nil {
+			return nil, errBadSignature
+		}
+		fields = append(fields, string(f))
+	}
+	return fields, nil
+}
+
+// secure reports whether the cookies set in answer to r should be HTTPS only
+func (s *Sessions) secure(r *http.Request) bool {
+	return s.Secure || r.TLS != nil
+}
+
+// SetUser starts a session for userID in answer to r
+func (s *Sessions) SetUser(w http.ResponseWriter, r *http.Request, userID string) {
+	expires := time.Now().Add(s.maxAge)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    s.sign(expires, userID),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// UserID returns the user ID of the session attached to the request
+func (s *Sessions) UserID(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", ErrNoSession
+	}
+
+	fields, err := s.verify(cookie.Value)
+	if err != nil || len(fields) != 1 || fields[0] == "" {
+		return "", ErrNoSession
+	}
+	return fields[0], nil
+}
+
+// Clear ends the session
+func (s *Sessions) Clear(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure(r),
+	})
+}
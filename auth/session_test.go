@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/i18n"
+)
+
+// testLocales loads the translations the handlers show errors in
+func testLocales(t *testing.T) *i18n.Bundle {
+	locales, err := i18n.Load()
+	if err != nil {
+		t.Fatalf("Couldn't load locales: %v", err)
+	}
+	return locales
+}
+
+// requestWith creates a request carrying the cookies set on rec
+func requestWith(rec *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest("GET", "/vote", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestSessionTampering(t *testing.T) {
+	sessions, _ := NewSessions([]string{"0123456789abcdef0123"}, time.Hour)
+
+	rec := httptest.NewRecorder()
+	sessions.SetUser(rec, httptest.NewRequest("GET", "/", nil), "jonny")
+	cookie := rec.Result().Cookies()[0]
+
+	req := httptest.NewRequest("GET", "/", nil)
+	cookie.Value = "YmlsbHk" + cookie.Value[len("am9ubnk"):] // billy
+	req.AddCookie(cookie)
+	if _, err := sessions.UserID(req); err != ErrNoSession {
+		t.Errorf("Expected tampered cookie to be rejected, got %v", err)
+	}
+
+	if _, err := NewSessions([]string{"short"}, time.Hour); err == nil {
+		t.Errorf("Expected short key to be rejected")
+	}
+	if _, err := NewSessions(nil, time.Hour); err == nil {
+		t.Errorf("Expected missing keys to be rejected")
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	oldKey, newKey := "old-key-0123456789", "new-key-0123456789"
+
+	before, _ := NewSessions([]string{oldKey}, time.Hour)
+	rotated, _ := NewSessions([]string{newKey, oldKey}, time.Hour)
+	after, _ := NewSessions([]string{newKey}, time.Hour)
+
+	rec := httptest.NewRecorder()
+	before.SetUser(rec, httptest.NewRequest("GET", "/", nil), "jonny")
+
+	if id, err := rotated.UserID(requestWith(rec)); err != nil || id != "jonny" {
+		t.Errorf("Expected rotated keys to accept old session, got %q %v", id, err)
+	}
+	if _, err := after.UserID(requestWith(rec)); err != ErrNoSession {
+		t.Errorf("Expected old session to be rejected once the old key is removed")
+	}
+}
+
+func TestSecureCookies(t *testing.T) {
+	/* each row takes the form:
+	{TLS on, request URL, cookies marked Secure}
+	*/
+	testData := []struct {
+		tls    bool
+		url    string
+		secure bool
+	}{
+		{false, "http://vote.example.com/vote", false},
+		{false, "https://vote.example.com/vote", true},
+		{true, "http://vote.example.com/vote", true},
+	}
+
+	for i, d := range testData {
+		sessions, _ := NewSessions([]string{"0123456789abcdef0123"}, time.Hour)
+		sessions.Secure = d.tls
+		login := NewDiscordLogin(config.Config{}, sessions, testLocales(t))
+
+		rec := httptest.NewRecorder()
+		sessions.SetUser(rec, httptest.NewRequest("GET", d.url, nil), "jonny")
+		sessions.Clear(rec, httptest.NewRequest("GET", d.url, nil))
+		login.LoginHandler().ServeHTTP(rec, httptest.NewRequest("GET", d.url, nil))
+
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 3 {
+			t.Fatalf("Test[%d] expected 3 cookies, got %d", i, len(cookies))
+		}
+		for _, c := range cookies {
+			if c.Secure != d.secure {
+				t.Errorf("Test[%d] expected %s to have Secure %v", i, c.Name, d.secure)
+			}
+		}
+	}
+}
+
+type memoryTokens map[string]bool
+
+func (m memoryTokens) RedeemToken(nonce string) (bool, error) {
+	if m[nonce] {
+		return false, nil
+	}
+	m[nonce] = true
+	return true, nil
+}
+
+func TestLoginLink(t *testing.T) {
+	sessions, _ := NewSessions([]string{"0123456789abcdef0123"}, time.Hour)
+	store := memoryTokens{}
+	locales := testLocales(t)
+
+	token, err := sessions.NewLinkToken("billy", time.Hour)
+	if err != nil {
+		t.Fatalf("Couldn't create link token: %v", err)
+	}
+
+	redeem := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login/link?token="+url.QueryEscape(token), nil)
+		req.Header.Set("Accept-Language", "fr")
+		sessions.LinkHandler(store, locales).ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := redeem(token)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected link to redirect, got %d", rec.Code)
+	}
+	if id, err := sessions.UserID(requestWith(rec)); err != nil || id != "billy" {
+		t.Errorf("Expected session for billy, got %q %v", id, err)
+	}
+
+	if rec := redeem(token); rec.Code != http.StatusGone || !strings.Contains(rec.Body.String(), "déjà été utilisé") {
+		t.Errorf("Expected second use of link to get 410 in French, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	expired, _ := sessions.NewLinkToken("billy", -time.Minute)
+	if rec := redeem(expired); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected expired link to get 401, got %d", rec.Code)
+	}
+
+	// A session cookie must not work as a login link
+	rec = httptest.NewRecorder()
+	sessions.SetUser(rec, httptest.NewRequest("GET", "/", nil), "billy")
+	if rec := redeem(rec.Result().Cookies()[0].Value); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected session cookie used as a link to get 401, got %d", rec.Code)
+	}
+}
+
+func TestIssueOnFirstVisit(t *testing.T) {
+	sessions, _ := NewSessions([]string{"0123456789abcdef0123"}, time.Hour)
+	page := sessions.IssueOnFirstVisit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), testLocales(t))
+
+	rec := httptest.NewRecorder()
+	page.ServeHTTP(rec, httptest.NewRequest("GET", "/vote", nil))
+	id, err := sessions.UserID(requestWith(rec))
+	if err != nil {
+		t.Fatalf("Expected a voter token on first visit: %v", err)
+	}
+
+	// A returning visitor keeps their ID
+	second := httptest.NewRecorder()
+	page.ServeHTTP(second, requestWith(rec))
+	if len(second.Result().Cookies()) != 0 {
+		t.Errorf("Expected no new token for returning visitor %s", id)
+	}
+}
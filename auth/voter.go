@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"Emoji-battle-royale/i18n"
+	"Emoji-battle-royale/logging"
+)
+
+// TokenStore remembers which one-time links have been used
+type TokenStore interface {
+	// RedeemToken marks nonce as used. It returns false if it already was.
+	RedeemToken(nonce string) (bool, error)
+}
+
+const anonymousPrefix = "anon-"
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeError sends the message key as a plain text error, translated for the user
+func writeError(w http.ResponseWriter, r *http.Request, locales *i18n.Bundle, key string, status int) {
+	http.Error(w, locales.FromRequest(r).T(key), status)
+}
+
+// NewLinkToken creates a token for a one-time login link which gives its holder a session as userID.
+// It's meant to be sent to the voter privately, the login-link command prints them.
+func (s *Sessions) NewLinkToken(userID string, ttl time.Duration) (string, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	return s.sign(time.Now().Add(ttl), userID, nonce), nil
+}
+
+// LinkHandler redeems a one-time link token from the "token" query parameter
+// and starts a session for the user it was issued to. Errors are shown in the user's language from locales.
+func (s *Sessions) LinkHandler(store TokenStore, locales *i18n.Bundle) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields, err := s.verify(r.URL.Query().Get("token"))
+		if err != nil || len(fields) != 2 || fields[0] == "" {
+			writeError(w, r, locales, "login.invalid_link", http.StatusUnauthorized)
+			return
+		}
+
+		redeemed, err := store.RedeemToken(fields[1])
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Unable to redeem link token", "error", err)
+			writeError(w, r, locales, "login.error", http.StatusInternalServerError)
+			return
+		}
+		if !redeemed {
+			writeError(w, r, locales, "login.used_link", http.StatusGone)
+			return
+		}
+
+		s.SetUser(w, r, fields[0])
+		http.Redirect(w, r, "/vote", http.StatusFound)
+	})
+}
+
+// IssueOnFirstVisit wraps next so that visitors without a session are given
+// a new anonymous voter ID before the page is served
+func (s *Sessions) IssueOnFirstVisit(next http.Handler, locales *i18n.Bundle) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.UserID(r); err == ErrNoSession {
+			id, err := randomHex(12)
+			if err != nil {
+				writeError(w, r, locales, "login.error", http.StatusInternalServerError)
+				return
+			}
+			s.SetUser(w, r, anonymousPrefix+id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"Emoji-battle-royale/auth"
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+	"Emoji-battle-royale/discord"
+	"Emoji-battle-royale/logging"
+	"Emoji-battle-royale/manifest"
+	"Emoji-battle-royale/scheduler"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const usage = `Usage: webserver [-config file] [-setting value...] <command> [arguments]
+
+Every config setting can also be set by an environment variable or a flag,
+e.g. EBR_SERVER_PORT=9090 or -server.port 9090. Run config fields for the full list.
+The config file can be set with EBR_CONFIG as well as -config.
+
+Commands:
+  serve                        run the web server (the default)
+  init [-force] [-candidates FILE]
+                               create a new database, with the candidates from CandidatesFile if set
+  candidates add [-name NAME] [-image PATH] ID...
+                               add candidates, optionally with a display name and image
+  candidates set [-name NAME] [-image PATH] ID
+                               change a candidate's display name or image
+  candidates load FILE         add the candidates in a TOML, JSON or CSV manifest
+  candidates list              list candidates with their status and votes
+  candidates remove ID...      remove candidates who haven't received any votes
+  discord import               download the emoji of the GuildID server and add them as candidates
+  discord crown [-dry-run]     run the Discord actions for the winner, or just list them
+  eliminate NAME...            eliminate candidates by hand, outside of the schedule
+  login-link [-ttl 24h] [-url URL] [-dm] USER...
+                               create a one-time login link for each voter, when LoginMode is token,
+                               and with -dm send each one to the Discord user of that ID
+  export [-format csv|json] [-o file]
+                               write all transactions as CSV, or the whole database as JSON
+  import FILE                  load a JSON export into a new database
+  verify                       check the database for inconsistencies
+  status                       show the phase, round and standings
+  config check                 list every problem with the config file
+  config show                  print the settings in use, with secrets redacted
+  config fields                list every setting with its environment variable and flag
+`
+
+// command is a CLI subcommand. args are the arguments after the command name.
+type command func(conf config.Config, args []string) error
+
+var commands = map[string]command{
+	"serve": func(conf config.Config, args []string) error {
+		serve(conf, configFile)
+		return nil
+	},
+	"init":       cmdInit,
+	"candidates": cmdCandidates,
+	"discord":    cmdDiscord,
+	"eliminate":  cmdEliminate,
+	"login-link": cmdLoginLink,
+	"export":     cmdExport,
+	"import":     cmdImport,
+	"verify":     cmdVerify,
+	"status":     cmdStatus,
+}
+
+// configFile and configOverrides are where the config comes from, set by the command line
+var configFile string
+var configOverrides config.Overrides
+
+// loadConfig loads the config the same way every time, so a reload sees the same overrides
+func loadConfig() (config.Config, error) {
+	return config.Load(configFile, configOverrides)
+}
+
+/***** MAIN *****/
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	defaultConfigFile := "config.toml"
+	if f, ok := os.LookupEnv("EBR_CONFIG"); ok {
+		defaultConfigFile = f
+	}
+	flag.StringVar(&configFile, "config", defaultConfigFile, "path to the config file")
+	configOverrides = config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	name := "serve"
+	args := flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	// The config commands need to run even when the config doesn't load
+	if name == "config" {
+		if err := cmdConfig(configFile, configOverrides, args); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+
+	conf, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if name == "serve" {
+		logging.Setup(os.Stdout)
+	}
+
+	if err := cmd(conf, args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func cmdConfig(configFile string, overrides config.Overrides, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected check, show or fields")
+	}
+
+	switch args[0] {
+	case "fields":
+		fmt.Printf("%-28s %-34s %s\n", "SETTING", "ENVIRONMENT", "FLAG")
+		for _, line := range config.Describe() {
+			fmt.Println(line)
+		}
+		return nil
+	case "check", "show":
+	default:
+		return fmt.Errorf("unknown config command %q, expected check, show or fields", args[0])
+	}
+
+	conf, err := config.Load(configFile, overrides)
+	var ve *config.ValidationError
+	if err != nil && !errors.As(err, &ve) {
+		return err
+	}
+
+	if args[0] == "show" {
+		// Show what would be used even if it isn't valid, that's often why someone is looking
+		enc := toml.NewEncoder(os.Stdout)
+		if err := enc.Encode(conf.Redact()); err != nil {
+			return err
+		}
+	}
+
+	if ve != nil {
+		// file:line: is what editors expect, to jump to the problem
+		for _, p := range ve.Problems {
+			line := p.Line
+			p.Line = 0
+			if line > 0 {
+				fmt.Fprintf(os.Stderr, "%s:%d: %s\n", configFile, line, p)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, p)
+			}
+		}
+		return fmt.Errorf("found %d problems", len(ve.Problems))
+	}
+	if args[0] == "check" {
+		fmt.Printf("%s OK\n", configFile)
+	}
+	return nil
+}
+
+// openStore opens the database named in the config for one of the admin commands
+func openStore(conf config.Config) (*database.Store, error) {
+	store, err := database.OpenDB(conf.DatabaseFile)
+	if err != nil {
+		return nil, fmt.Errorf("%v (is the server still running? it holds a lock on the database)", err)
+	}
+	created, err := store.Migrate()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if len(created) > 0 {
+		fmt.Printf("Added %s to %s, which was made by an older version\n", strings.Join(created, ", "), conf.DatabaseFile)
+	}
+	return store, nil
+}
+
+func cmdInit(conf config.Config, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	force := flags.Bool("force", false, "overwrite an existing database")
+	candidatesFile := flags.String("candidates", conf.CandidatesFile, "manifest of candidates to add")
+	flags.Parse(args)
+
+	// Check the manifest first so a bad one doesn't leave an empty database behind
+	var candidates []database.Candidate
+	if *candidatesFile != "" {
+		var err error
+		if candidates, err = manifest.Load(*candidatesFile, conf.ImageDir); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(conf.DatabaseFile); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", conf.DatabaseFile)
+	}
+
+	store, err := database.CreateOrOverwriteDB(conf.DatabaseFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.InitializeCandidates(candidates); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s", conf.DatabaseFile)
+	if len(candidates) > 0 {
+		fmt.Printf(" with %d candidates from %s, %d rounds", len(candidates), *candidatesFile, len(candidates)-1)
+	}
+	fmt.Println()
+	return nil
+}
+
+func cmdCandidates(conf config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected add, set, load, list or remove")
+	}
+
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// add and set take the display name and image as flags
+	flags := flag.NewFlagSet("candidates "+args[0], flag.ExitOnError)
+	displayName := flags.String("name", "", "the name shown to voters instead of the ID")
+	image := flags.String("image", "", "the candidate's image, relative to ImageDir")
+
+	switch sub, names := args[0], args[1:]; sub {
+	case "add":
+		flags.Parse(names)
+		names = flags.Args()
+		if len(names) > 1 && (*displayName != "" || *image != "") {
+			return fmt.Errorf("-name and -image can only be used when adding one candidate")
+		}
+		for _, name := range names {
+			if err := store.AddCandidate(name); err != nil {
+				return err
+			}
+			if *displayName != "" || *image != "" {
+				info := database.CandidateInfo{Name: *displayName, Image: *image}
+				if err := store.SetCandidateInfo(name, info); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("Added %s\n", name)
+		}
+	case "set":
+		flags.Parse(names)
+		if flags.NArg() != 1 {
+			return fmt.Errorf("expected the ID of one candidate")
+		}
+		id := flags.Arg(0)
+
+		// Only change what was given on the command line
+		info := database.CandidateInfo{}
+		for _, can := range store.GetCandidates(true) {
+			if can.ID == id {
+				info = can.CandidateInfo
+			}
+		}
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "name":
+				info.Name = *displayName
+			case "image":
+				info.Image = *image
+			}
+		})
+		if err := store.SetCandidateInfo(id, info); err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s\n", id)
+	case "remove":
+		for _, name := range names {
+			if err := store.RemoveCandidate(name); err != nil {
+				return err
+			}
+			fmt.Printf("Removed %s\n", name)
+		}
+	case "load":
+		if len(names) != 1 {
+			return fmt.Errorf("expected the manifest to load")
+		}
+		candidates, err := manifest.Load(names[0], conf.ImageDir)
+		if err != nil {
+			return err
+		}
+		if err := store.InitializeCandidates(candidates); err != nil {
+			return err
+		}
+		fmt.Printf("Added %d candidates from %s\n", len(candidates), names[0])
+	case "list":
+		printStandings(os.Stdout, store)
+	default:
+		return fmt.Errorf("unknown candidates command %q, expected add, set, load, list or remove", sub)
+	}
+	return nil
+}
+
+func cmdDiscord(conf config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected import or crown")
+	}
+	switch args[0] {
+	case "import":
+		return discordImport(conf)
+	case "crown":
+		return discordCrown(conf, args[1:])
+	}
+	return fmt.Errorf("unknown discord command %q, expected import or crown", args[0])
+}
+
+func discordImport(conf config.Config) error {
+	session, err := discord.NewSession(conf)
+	if err != nil {
+		return err
+	}
+	importer, err := discord.NewImporter(session, conf)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := importer.Import(context.Background(), store)
+	var downloadErr *discord.DownloadError
+	if err == nil || errors.As(err, &downloadErr) {
+		fmt.Printf("Downloaded %d emoji into %s, %d were unchanged, %d failed\n",
+			report.Downloaded, filepath.Join(conf.ImageDir, conf.Discord.EmojiDir), report.Unchanged, len(report.Failures))
+	}
+	if downloadErr != nil {
+		return fmt.Errorf("%v\nNo candidates were added, run it again to retry the failed emoji", err)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %d emoji from guild %s, updated %d\n", report.Added, conf.GuildID, report.Downloaded+report.Unchanged-report.Added)
+	return nil
+}
+
+func discordCrown(conf config.Config, args []string) error {
+	flags := flag.NewFlagSet("discord crown", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", conf.Discord.CrownDryRun, "list the actions without running them")
+	flags.Parse(args)
+
+	session, err := discord.NewSession(conf)
+	if err != nil {
+		return err
+	}
+	crowner := discord.NewCrowner(session, conf)
+
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	results := store.GetResults()
+	if results.Winner == "" {
+		return fmt.Errorf("there is no winner yet")
+	}
+
+	actions := crowner.Plan(conf.ElectionName, results, store.GetCandidates(true), store.GetAllTransactions())
+	if len(actions) == 0 {
+		fmt.Println("Nothing to do, turn on some of the actions in the Discord section of the config")
+	}
+	failed := 0
+	for _, a := range actions {
+		if *dryRun {
+			fmt.Printf("Would %s\n", lowerFirst(a.Description))
+			continue
+		}
+		if err := a.Run(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to %s: %v\n", lowerFirst(a.Description), err)
+			failed++
+			continue
+		}
+		fmt.Println(a.Description)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d actions failed", failed, len(actions))
+	}
+	return nil
+}
+
+// lowerFirst makes the first letter of s lower case, to put it in the middle of a sentence
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func cmdEliminate(conf config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected the names of candidates to eliminate")
+	}
+
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	for _, name := range args {
+		if err := store.EliminateCandidate(name); err != nil {
+			return err
+		}
+		fmt.Printf("Eliminated %s\n", name)
+	}
+	return nil
+}
+
+func cmdLoginLink(conf config.Config, args []string) error {
+	flags := flag.NewFlagSet("login-link", flag.ExitOnError)
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the link works for if it isn't used")
+	base := flags.String("url", siteURL(conf), "address of the site, as voters reach it")
+	dm := flags.Bool("dm", false, "send each link to the Discord user with that ID from the bot, instead of printing it")
+	flags.Parse(args)
+
+	if conf.LoginMode != "token" {
+		return fmt.Errorf("login links only work when LoginMode is token")
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("expected the user IDs to create links for")
+	}
+
+	s, err := auth.NewSessions(conf.SessionKeys, sessionMaxAge)
+	if err != nil {
+		return err
+	}
+
+	var client discord.Client
+	if *dm {
+		if client, err = discord.NewSession(conf); err != nil {
+			return err
+		}
+	}
+	return sendLoginLinks(client, s, conf.ElectionName, *base, flags.Args(), *ttl)
+}
+
+// sendLoginLinks creates a link for each of userIDs and sends it through client,
+// or prints them if client is nil. Every user is tried, and the last error is returned.
+func sendLoginLinks(client discord.Client, s *auth.Sessions, electionName string, base string, userIDs []string, ttl time.Duration) error {
+	var failed error
+	for _, userID := range userIDs {
+		link, err := loginLink(s, base, userID, ttl)
+		if err != nil {
+			return err
+		}
+		switch {
+		case client != nil:
+			if err := discord.SendLoginLink(context.Background(), client, userID, electionName, link, time.Now().Add(ttl)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = err
+				continue
+			}
+			fmt.Printf("Sent a link to %s\n", userID)
+		case len(userIDs) == 1:
+			fmt.Println(link)
+		default:
+			fmt.Printf("%s\t%s\n", userID, link)
+		}
+	}
+	return failed
+}
+
+// siteURL is where the server listens, going by the Server section
+func siteURL(conf config.Config) string {
+	scheme := "http"
+	if conf.Server.TLSCertFile != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(conf.Server.Address, strconv.Itoa(conf.Server.Port))
+}
+
+// loginLink creates a one-time link to the site at base which logs its holder in as userID
+func loginLink(s *auth.Sessions, base string, userID string, ttl time.Duration) (string, error) {
+	if userID == "" {
+		return "", fmt.Errorf("user ID cannot be empty")
+	}
+	token, err := s.NewLinkToken(userID, ttl)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(base, "/") + "/login/link?token=" + url.QueryEscape(token), nil
+}
+
+func cmdExport(conf config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "csv", "csv for a list of transactions, json for the whole database")
+	output := flags.String("o", "", "file to write to instead of standard output")
+	flags.Parse(args)
+
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "csv":
+		store.ExportAllTransactionsAsCSV(w)
+		return nil
+	case "json":
+		return store.Export(w)
+	}
+	return fmt.Errorf("unknown format %q, expected csv or json", *format)
+}
+
+func cmdImport(conf config.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected the file to import")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := store.Import(f); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %s into %s\n", args[0], conf.DatabaseFile)
+	return verifyStore(store)
+}
+
+func cmdVerify(conf config.Config, args []string) error {
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return verifyStore(store)
+}
+
+// verifyStore prints every consistency problem in the database
+func verifyStore(store *database.Store) error {
+	problems := store.CheckConsistency()
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	fmt.Println("Database OK")
+	return nil
+}
+
+func cmdStatus(conf config.Config, args []string) error {
+	store, err := openStore(conf)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	candidates := store.GetCandidateList(true)
+	results := store.GetResults()
+
+	fmt.Printf("Election:      %s\n", conf.ElectionName)
+	fmt.Printf("Schedule:      %s to %s\n", conf.StartTime.Format("2006-01-02 15:04 MST"), conf.EndTime.Format("2006-01-02 15:04 MST"))
+	if len(candidates) >= 2 {
+		sched := scheduler.CreateSchedule(conf.StartTime, conf.EndTime, len(candidates)-1)
+		fmt.Printf("Phase:         %s\n", sched.GetPhase())
+		fmt.Printf("Round:         %d of %d (%d eliminations recorded)\n", sched.GetRound(), len(candidates)-1, len(results.Rounds))
+	}
+	fmt.Printf("Participation: %d votes from %d voters in %d transactions\n\n", results.TotalVotes, results.Voters, results.Transactions)
+
+	printStandings(os.Stdout, store)
+	return nil
+}
+
+// printStandings writes a table of every candidate, their status and their votes
+func printStandings(w io.Writer, store *database.Store) {
+	results := store.GetResults()
+	candidates := make(map[string]database.Candidate)
+	for _, can := range store.GetCandidates(true) {
+		candidates[can.ID] = can
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PLACE\tCANDIDATE\tNAME\tIMAGE\tTAGS\tVOTES\tSTATUS")
+	for _, s := range results.Standings {
+		status := "active"
+		if s.EliminatedIn > 0 {
+			status = fmt.Sprintf("eliminated in round %d", s.EliminatedIn)
+		} else if s.Disqualified {
+			status = "eliminated by hand"
+		}
+		can := candidates[s.Candidate]
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%s\n", s.Place, s.Candidate, can.DisplayName(), can.Image, strings.Join(can.Tags, " "), s.Votes, status)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"Emoji-battle-royale/auth"
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+	"Emoji-battle-royale/discord/discordtest"
+	"Emoji-battle-royale/i18n"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginLink(t *testing.T) {
+	s, err := auth.NewSessions([]string{"0123456789abcdef"}, sessionMaxAge)
+	if err != nil {
+		t.Fatalf("Couldn't create sessions: %v", err)
+	}
+	if locales, err = i18n.Load(); err != nil {
+		t.Fatalf("Couldn't load locales: %v", err)
+	}
+	store, err := database.CreateOrOverwriteDB(filepath.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer store.Close()
+
+	link, err := loginLink(s, "https://vote.example.com/", "billy", time.Hour)
+	if err != nil {
+		t.Fatalf("Couldn't create a link: %v", err)
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Host != "vote.example.com" || u.Path != "/login/link" {
+		t.Fatalf("Unexpected link %q", link)
+	}
+
+	// Follow the link the way the server routes it
+	redeem := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.LinkHandler(store, locales).ServeHTTP(rec, httptest.NewRequest("GET", u.RequestURI(), nil))
+		return rec
+	}
+
+	rec := redeem()
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected the link to log in, got %d %s", rec.Code, rec.Body.String())
+	}
+	req := httptest.NewRequest("GET", "/vote", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if userID, err := s.UserID(req); err != nil || userID != "billy" {
+		t.Errorf("Expected a session for billy, got %q %v", userID, err)
+	}
+	if rec := redeem(); rec.Code != http.StatusGone {
+		t.Errorf("Expected the link to work only once, got %d", rec.Code)
+	}
+
+	if _, err := loginLink(s, "https://vote.example.com", "", time.Hour); err == nil {
+		t.Errorf("Expected a link for nobody to fail")
+	}
+}
+
+func TestLoginLinkDM(t *testing.T) {
+	s, err := auth.NewSessions([]string{"0123456789abcdef"}, sessionMaxAge)
+	if err != nil {
+		t.Fatalf("Couldn't create sessions: %v", err)
+	}
+	if locales, err = i18n.Load(); err != nil {
+		t.Fatalf("Couldn't load locales: %v", err)
+	}
+	store, err := database.CreateOrOverwriteDB(filepath.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer store.Close()
+
+	guild := discordtest.New("152893724500819969")
+	defer guild.Close()
+	guild.AddMember("80351110224678912")
+
+	err = sendLoginLinks(guild, s, "Emoji Battle", "https://vote.example.com", []string{"80351110224678913", "80351110224678912"}, time.Hour)
+	if err == nil {
+		t.Errorf("Expected the user outside the server to be reported")
+	}
+
+	dms := guild.DMs("80351110224678912")
+	if len(dms) != 1 {
+		t.Fatalf("Expected one DM, got %d", len(dms))
+	}
+	i := strings.Index(dms[0].Content, "https://")
+	if i < 0 {
+		t.Fatalf("Expected a link in %q", dms[0].Content)
+	}
+	u, err := url.Parse(dms[0].Content[i:])
+	if err != nil {
+		t.Fatalf("Couldn't parse the link: %v", err)
+	}
+
+	// The link in the DM logs its reader in
+	rec := httptest.NewRecorder()
+	s.LinkHandler(store, locales).ServeHTTP(rec, httptest.NewRequest("GET", u.RequestURI(), nil))
+	req := httptest.NewRequest("GET", "/vote", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if userID, err := s.UserID(req); err != nil || userID != "80351110224678912" {
+		t.Errorf("Expected the DM's link to log in its reader, got %q %v", userID, err)
+	}
+}
+
+func TestSiteURL(t *testing.T) {
+	conf := config.Config{Server: config.ServerConfig{Address: "127.0.0.1", Port: 8080}}
+	if got := siteURL(conf); got != "http://127.0.0.1:8080" {
+		t.Errorf("Unexpected site URL %q", got)
+	}
+	conf.Server.TLSCertFile = "cert.pem"
+	if got := siteURL(conf); !strings.HasPrefix(got, "https://") {
+		t.Errorf("Expected https with TLS on, got %q", got)
+	}
+}
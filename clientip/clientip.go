@@ -0,0 +1,88 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/* When we sit behind a reverse proxy every request comes from the proxy's address,
+and the real client is in the X-Forwarded-For header. Anyone can send that header
+though, so it's only believed when the request came from a proxy we trust.
+
+Each proxy appends the address it received the request from, so the header is read
+from right to left and the first address which isn't a trusted proxy is the client.
+*/
+
+// Resolver finds the IP address of the client that made a request
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// New creates a Resolver which trusts X-Forwarded-For from the given proxies.
+// Each proxy can be a single IP address or a CIDR range such as "10.0.0.0/8".
+func New(trustedProxies []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, p := range trustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", p)
+			}
+			if ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %v", p, err)
+		}
+		r.trusted = append(r.trusted, ipnet)
+	}
+	return r, nil
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IP returns the address of the client which made the request
+func (r *Resolver) IP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !r.isTrusted(ip) {
+		return host
+	}
+
+	// The header may be sent more than once, which is the same as a comma separated list
+	var hops []string
+	for _, h := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Something before this point mangled the header, so stop trusting it
+			break
+		}
+		host = hop.String()
+		if !r.isTrusted(hop) {
+			break
+		}
+	}
+	return host
+}
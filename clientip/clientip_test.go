@@ -0,0 +1,55 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIP(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Couldn't create resolver: %v", err)
+	}
+
+	testData := []struct {
+		remote   string
+		forwards []string
+		expected string
+	}{
+		// Direct connections ignore the header
+		{"203.0.113.7:5000", nil, "203.0.113.7"},
+		{"203.0.113.7:5000", []string{"1.2.3.4"}, "203.0.113.7"},
+		// Through a trusted proxy
+		{"192.168.1.1:5000", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"10.1.2.3:5000", []string{"203.0.113.7, 10.9.9.9"}, "203.0.113.7"},
+		{"10.1.2.3:5000", []string{"203.0.113.7", "10.9.9.9"}, "203.0.113.7"},
+		// A client can't spoof its address by adding to the header
+		{"10.1.2.3:5000", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		// Garbage in the header stops the search
+		{"10.1.2.3:5000", []string{"1.2.3.4, nonsense"}, "10.1.2.3"},
+		// All trusted hops means the leftmost is the client
+		{"10.1.2.3:5000", []string{"10.0.0.1, 10.0.0.2"}, "10.0.0.1"},
+		// A trusted proxy that didn't add the header
+		{"10.1.2.3:5000", nil, "10.1.2.3"},
+	}
+
+	for i, d := range testData {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = d.remote
+		for _, f := range d.forwards {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+
+		if ip := r.IP(req); ip != d.expected {
+			t.Errorf("Test[%d] expected %s, got %s", i, d.expected, ip)
+		}
+	}
+}
+
+func TestInvalidProxies(t *testing.T) {
+	for _, p := range []string{"nonsense", "10.0.0.0/99", ""} {
+		if _, err := New([]string{p}); err == nil {
+			t.Errorf("Expected %q to be rejected", p)
+		}
+	}
+}
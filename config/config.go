@@ -1,7 +1,11 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -13,18 +17,236 @@ type Config struct {
 	DatabaseFile string
 	StartTime    time.Time
 	EndTime      time.Time
-	DiscordKey   string
+	DiscordKey   string `config:"secret"`
+	// DiscordKeyFile is a file holding the DiscordKey, so it can be kept out of the config
+	DiscordKeyFile string
+
+	// PublicDir is an optional directory of pages and resources which replace the built in ones,
+	// e.g. for theming. Files it doesn't contain are still served from the binary.
+	PublicDir string
+	// CandidatesFile is a TOML, JSON or CSV manifest of the candidates, loaded into a new database
+	CandidatesFile string
+	// ImageDir holds the candidate images, served under /img/. Each candidate's image path is relative to it.
+	ImageDir string
+
+	// ShutdownTimeout is how long to wait for in-flight requests when stopping, e.g. "10s"
+	ShutdownTimeout time.Duration
+
+	// GuildID is the Discord server whose members are allowed to vote
+	GuildID string
+	// SessionKeys sign voter session cookies and login links. The first key is used to sign,
+	// the rest are still accepted so keys can be rotated without logging everyone out.
+	SessionKeys []string `config:"secret"`
+	// SessionKeysFile is a file holding the SessionKeys, one per line
+	SessionKeysFile string
+	// LoginMode is how voters are identified: "discord" for OAuth2 login or "token" for signed voter tokens
+	LoginMode string
+	// TokenOnFirstVisit gives every new visitor a voter token when LoginMode is "token".
+	// Otherwise voters need a one-time login link.
+	TokenOnFirstVisit bool
+
+	Server    ServerConfig
+	OAuth     OAuthConfig
+	RateLimit RateLimitConfig
+	Discord   DiscordConfig
+}
+
+// ServerConfig sets where and how the web server listens
+type ServerConfig struct {
+	Address      string
+	Port         int
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// Serve HTTPS when both of these are set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header is believed
+	TrustedProxies []string
+}
+
+// OAuthConfig holds the Discord OAuth2 application settings.
+// The endpoint URLs default to Discord's and only need to be set for testing.
+type OAuthConfig struct {
+	ClientID     string
+	ClientSecret string `config:"secret"`
+	// ClientSecretFile is a file holding the ClientSecret
+	ClientSecretFile string
+	RedirectURL      string
+	AuthURL          string
+	TokenURL         string
+	APIURL           string
 }
 
-// LoadConfig creates a new config from a file
+// RateLimitConfig sets how often votes can be posted, and how many one post can carry.
+// Rates are in requests per second, a rate of 0 turns that limit off.
+type RateLimitConfig struct {
+	VoterRate  float64
+	VoterBurst int
+	IPRate     float64
+	IPBurst    int
+
+	// MaxVotesPerCandidate and MaxVotesPerTransaction cap the votes in a single post,
+	// so one request can't carry more clicks than a voter could make between posts
+	MaxVotesPerCandidate   int
+	MaxVotesPerTransaction int
+}
+
+// DiscordConfig sets how the emoji of the server in GuildID are imported as candidates,
+// and where the battle is announced. The bot token is DiscordKey.
+type DiscordConfig struct {
+	// EmojiDir is where imported emoji are saved, relative to ImageDir
+	EmojiDir string
+	// CDNURL is where emoji images are downloaded from. It defaults to Discord's and only needs to be set for testing.
+	CDNURL string
+	// Downloads is how many emoji are downloaded at once
+	Downloads int
+	// DownloadTimeout limits each attempt at downloading an emoji, e.g. "30s"
+	DownloadTimeout time.Duration
+	// DownloadRetries is how many more times a download is tried after a network or server error
+	DownloadRetries int
+	// MaxEmojiSize is the largest emoji image accepted, in bytes
+	MaxEmojiSize int
+
+	// AnnounceChannel is the ID of a channel where the bot posts the start, each elimination and the winner.
+	// The bot is off when it isn't set.
+	AnnounceChannel string
+	// VoteURL is the address of the vote page, linked to in announcements
+	VoteURL string
+	// Voting lets members vote with the /vote command, and by reacting to ballots posted in AnnounceChannel
+	Voting bool
+
+	// Crown runs the actions below on the server once the winner is decided. CrownDryRun only logs them.
+	Crown       bool
+	CrownDryRun bool
+	// ChampionPrefix is added to the name of the winning emoji, e.g. "champion_". Empty leaves it alone.
+	ChampionPrefix string
+	// Losers is what happens to the other emoji: "keep" them, "archive" them by adding ArchivePrefix
+	// to their names, or "remove" them from the server
+	Losers        string
+	ArchivePrefix string
+	// ChampionRole is the ID of a role given to the TopVoters members whose weighted votes counted the most
+	ChampionRole string
+	TopVoters    int
+	// PinResults posts the final results in AnnounceChannel and pins them
+	PinResults bool
+
+	// RoleWeights maps role IDs to how many times a vote from a member with that role counts.
+	// Members with several of the roles get the highest weight, everyone else counts once.
+	RoleWeights map[string]int
+}
+
+// defaultConfig holds the values used for anything not set in the config file
+func defaultConfig() Config {
+	return Config{
+		ShutdownTimeout: 10 * time.Second,
+		ImageDir:        "public",
+		Server: ServerConfig{
+			Address:      "127.0.0.1",
+			Port:         8080,
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		},
+		RateLimit: RateLimitConfig{
+			VoterRate:  1,
+			VoterBurst: 5,
+			IPRate:     5,
+			IPBurst:    20,
+
+			MaxVotesPerCandidate:   100,
+			MaxVotesPerTransaction: 200,
+		},
+		Discord: DiscordConfig{
+			EmojiDir:        "emoji",
+			CDNURL:          "https://cdn.discordapp.com/",
+			Downloads:       4,
+			DownloadTimeout: 30 * time.Second,
+			DownloadRetries: 3,
+			MaxEmojiSize:    1 << 20,
+			ChampionPrefix:  "champion_",
+			Losers:          "keep",
+			ArchivePrefix:   "archived_",
+			TopVoters:       3,
+			PinResults:      true,
+		},
+	}
+}
+
+// LoadConfig creates a new config from a file and the environment.
+// If there are unknown keys or invalid settings, a *ValidationError listing all of them is returned.
 func LoadConfig(filename string) (Config, error) {
-	var conf Config
-	if _, err := toml.DecodeFile(filename, &conf); err != nil {
+	return Load(filename, nil)
+}
+
+// Load creates a new config from a file, the environment and command line overrides, in that order.
+// See overrides.go for how the environment and flags are named.
+func Load(filename string, o Overrides) (Config, error) {
+	conf := defaultConfig()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
 		return conf, fmt.Errorf("Unable to load config %s: %v", filename, err)
 	}
+
+	md, err := toml.Decode(string(data), &conf)
+	if err != nil {
+		// The file can't be checked any further until it decodes
+		return conf, &ValidationError{File: filename, Problems: []Problem{decodeProblem(err)}}
+	}
+
+	lines := keyLines(data)
+	var problems []Problem
+	unknown := make(map[string]bool)
+	for _, key := range md.Undecoded() {
+		unknown[key.String()] = true
+		// An unknown table is enough, without listing every key in it
+		if len(key) > 1 && unknown[key[:len(key)-1].String()] {
+			continue
+		}
+		problems = append(problems, Problem{Field: key.String(), Line: findLine(lines, key.String()), Message: "unknown setting"})
+	}
+
+	sources, overrideProblems := applyOverrides(&conf, o)
+	problems = append(problems, overrideProblems...)
+	problems = append(problems, readSecretFiles(&conf)...)
+
+	for _, p := range Validate(conf) {
+		// Overridden settings can't be blamed on a line in the file
+		if source, ok := sources[p.Field]; ok {
+			p.Message += " (set by " + source + ")"
+		} else {
+			p.Line = findLine(lines, p.Field)
+		}
+		problems = append(problems, p)
+	}
+
+	if len(problems) > 0 {
+		sortProblems(problems)
+		return conf, &ValidationError{File: filename, Problems: problems}
+	}
 	return conf, nil
 }
 
+// decodeTypeError matches the errors the decoder gives for values of the wrong type
+var decodeTypeError = regexp.MustCompile(`^toml: line (\d+) \(last key "([^"]*)"\): (.*)$`)
+
+// decodeProblem turns an error from the TOML decoder into a Problem
+func decodeProblem(err error) Problem {
+	var pe toml.ParseError
+	if errors.As(err, &pe) {
+		return Problem{Field: pe.LastKey, Line: pe.Position.Line, Message: pe.Message}
+	}
+	if m := decodeTypeError.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return Problem{Field: m[2], Line: line, Message: m[3]}
+	}
+	return Problem{Message: err.Error()}
+}
+
 func main() {
 	fmt.Printf("Pi: %f\n", 3.1235235)
 }
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validConfig = `
+DatabaseFile = "test.db"
+StartTime = 2030-07-05T05:45:00Z
+EndTime = 2030-07-06T05:45:00Z
+SessionKeys = ["0123456789abcdef"]
+LoginMode = "token"
+
+[Server]
+Port = 8080
+`
+
+// writeConfig saves a config file in a temporary directory and returns its path
+func writeConfig(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadConfig(t *testing.T) {
+	conf, err := LoadConfig(writeConfig(t, validConfig))
+	if err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+	if conf.Server.Port != 8080 || conf.Server.Address != "127.0.0.1" {
+		t.Errorf("Expected the port from the file and the default address, got %+v", conf.Server)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	contents := `
+DatabaseFile = "votes"
+StartTime = 2030-07-05T05:45:00Z
+EndTime = 2030-07-04T05:45:00Z
+SessionKeys = ["short"]
+LoginMode = "token"
+Colour = "blue"
+
+[Server]
+Port = 0
+TrustedProxies = ["10.0.0.0/8", "not-an-ip"]
+
+[Extras]
+A = 1
+B = 2
+`
+
+	_, err := LoadConfig(writeConfig(t, contents))
+	var ve *ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+
+	// Every problem is reported at once, in file order
+	expected := []Problem{
+		{Field: "DatabaseFile", Line: 2},
+		{Field: "EndTime", Line: 4},
+		{Field: "SessionKeys", Line: 5},
+		{Field: "Colour", Line: 7},
+		{Field: "Server.Port", Line: 10},
+		{Field: "Server.TrustedProxies", Line: 11},
+		{Field: "Extras", Line: 13},
+	}
+	if len(ve.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(ve.Problems), ve)
+	}
+	for i, p := range ve.Problems {
+		if p.Field != expected[i].Field || p.Line != expected[i].Line {
+			t.Errorf("Test[%d] expected %s on line %d, got %s", i, expected[i].Field, expected[i].Line, p)
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	/* each row takes the form:
+	{contents, expected field, expected line}
+	*/
+	testData := []struct {
+		contents string
+		field    string
+		line     int
+	}{
+		{validConfig + "[RateLimit]\nIPRate = \"fast\"\n", "RateLimit.IPRate", 11},
+		{validConfig + "Port = \n", "Server.Port", 10},
+	}
+
+	for i, d := range testData {
+		_, err := LoadConfig(writeConfig(t, d.contents))
+		var ve *ValidationError
+		if !errors.As(err, &ve) || len(ve.Problems) != 1 {
+			t.Errorf("Test[%d] expected one problem, got %v", i, err)
+			continue
+		}
+		if p := ve.Problems[0]; p.Field != d.field || p.Line != d.line {
+			t.Errorf("Test[%d] expected %q on line %d, got %s", i, d.field, d.line, p)
+		}
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	filename := writeConfig(t, validConfig+"ReadTimeout = \"5s\"\n")
+
+	t.Setenv("EBR_SERVER_PORT", "9000")
+	t.Setenv("EBR_SERVER_READ_TIMEOUT", "7s")
+	t.Setenv("EBR_ELECTION_NAME", "From the environment")
+	t.Setenv("EBR_SERVER_TRUSTED_PROXIES", "10.0.0.1, 10.0.0.2")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := RegisterFlags(fs)
+	if err := fs.Parse([]string{"-server.port", "9100", "-ratelimit.voter-rate", "2.5"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := Load(filename, o)
+	if err != nil {
+		t.Fatalf("Couldn't load config: %v", err)
+	}
+
+	// Flags beat the environment, which beats the file
+	if conf.Server.Port != 9100 || conf.Server.ReadTimeout != 7*time.Second || conf.RateLimit.VoterRate != 2.5 ||
+		conf.ElectionName != "From the environment" || len(conf.Server.TrustedProxies) != 2 {
+		t.Errorf("Overrides not applied: %+v", conf)
+	}
+
+	// Bad values are reported against the variable they came from
+	t.Setenv("EBR_SERVER_PORT", "ninety")
+	t.Setenv("EBR_END_TIME", "2000-01-01T00:00:00Z")
+	_, err = Load(filename, nil)
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Problems) != 2 {
+		t.Fatalf("Expected 2 problems, got %v", err)
+	}
+	for _, p := range ve.Problems {
+		if p.Line != 0 || !strings.Contains(p.Message, "EBR_") {
+			t.Errorf("Expected a problem naming the environment variable, got %s", p)
+		}
+	}
+}
+
+func TestRoleWeights(t *testing.T) {
+	base := "GuildID = \"152893724500819969\"\nDiscordKey = \"key\"\n" + validConfig + "[Discord]\n"
+
+	/* each row takes the form:
+	{file, EBR_DISCORD_ROLE_WEIGHTS, expected weights, problems}
+	*/
+	testData := []struct {
+		file     string
+		env      string
+		weights  map[string]int
+		problems int
+	}{
+		{`RoleWeights = { "585871423394185226" = 2 }`, "", map[string]int{"585871423394185226": 2}, 0},
+		{"", "585871423394185226=3, 585871423394185227=1", map[string]int{"585871423394185226": 3, "585871423394185227": 1}, 0},
+		{`RoleWeights = { booster = 0 }`, "", nil, 2},
+		{"", "585871423394185226", nil, 1},
+	}
+
+	for i, d := range testData {
+		if d.env != "" {
+			t.Setenv("EBR_DISCORD_ROLE_WEIGHTS", d.env)
+		}
+		conf, err := LoadConfig(writeConfig(t, base+d.file+"\n"))
+		os.Unsetenv("EBR_DISCORD_ROLE_WEIGHTS")
+
+		var ve *ValidationError
+		switch {
+		case d.problems == 0 && err != nil:
+			t.Errorf("Test[%d] couldn't load config: %v", i, err)
+		case d.problems > 0 && (!errors.As(err, &ve) || len(ve.Problems) != d.problems):
+			t.Errorf("Test[%d] expected %d problems, got %v", i, d.problems, err)
+		case d.problems == 0 && !reflect.DeepEqual(conf.Discord.RoleWeights, d.weights):
+			t.Errorf("Test[%d] expected %v, got %v", i, d.weights, conf.Discord.RoleWeights)
+		}
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "discord"), []byte("bot-key\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "sessions"), []byte("0123456789abcdef\r\nfedcba98,76543210\n\n"), 0600)
+
+	t.Setenv("EBR_DISCORD_KEY_FILE", filepath.Join(dir, "discord"))
+	t.Setenv("EBR_SESSION_KEYS_FILE", filepath.Join(dir, "sessions"))
+
+	conf, err := LoadConfig(writeConfig(t, validConfig))
+	if err != nil {
+		t.Fatalf("Couldn't load config: %v", err)
+	}
+	if conf.DiscordKey != "bot-key" || len(conf.SessionKeys) != 2 || conf.SessionKeys[1] != "fedcba98,76543210" {
+		t.Errorf("Secrets not read from files: %q %q", conf.DiscordKey, conf.SessionKeys)
+	}
+
+	redacted := conf.Redact()
+	if redacted.DiscordKey != Redacted || redacted.SessionKeys[0] != Redacted || redacted.OAuth.ClientSecret != "" {
+		t.Errorf("Secrets not redacted: %+v", redacted)
+	}
+	if conf.SessionKeys[0] != "0123456789abcdef" {
+		t.Errorf("Redact changed the original config")
+	}
+
+	t.Setenv("EBR_DISCORD_KEY_FILE", filepath.Join(dir, "missing"))
+	if _, err := LoadConfig(writeConfig(t, validConfig)); err == nil {
+		t.Errorf("Expected a missing secret file to be an error")
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	testData := [][]string{
+		{"ElectionName", "election_name"},
+		{"TLSCertFile", "tls_cert_file"},
+		{"GuildID", "guild_id"},
+		{"APIURL", "apiurl"},
+		{"Port", "port"},
+	}
+
+	for i, d := range testData {
+		if got := snakeCase(d[0]); got != d[1] {
+			t.Errorf("Test[%d] expected %s, got %s", i, d[1], got)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	current, err := LoadConfig(writeConfig(t, validConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := current
+	next.Server.TrustedProxies = []string{}
+	next.ElectionName = "Renamed"
+	next.RateLimit.IPRate = 50
+	next.Server.Port = 9000
+	next.SessionKeys = []string{"another-key-that-is-long"}
+	// The same time in another zone isn't a change
+	next.StartTime = current.StartTime.In(time.FixedZone("UTC+1", 3600))
+
+	reloaded, applied, needRestart := Reload(current, next)
+
+	if strings.Join(applied, ",") != "ElectionName,RateLimit.IPRate" {
+		t.Errorf("Unexpected applied settings %v", applied)
+	}
+	if strings.Join(needRestart, ",") != "SessionKeys,Server.Port" {
+		t.Errorf("Unexpected restart settings %v", needRestart)
+	}
+	if reloaded.ElectionName != "Renamed" || reloaded.RateLimit.IPRate != 50 || reloaded.Server.Port != 8080 || reloaded.SessionKeys[0] != current.SessionKeys[0] {
+		t.Errorf("Wrong settings reloaded: %+v", reloaded)
+	}
+	if current.ElectionName != "" {
+		t.Errorf("Reload changed the current config")
+	}
+}
@@ -0,0 +1,281 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/* Settings are applied in this order, later ones winning:
+
+  defaults < config file < environment variables < command line flags
+
+Every field has an environment variable and a flag, named after it:
+Server.Port is EBR_SERVER_PORT and -server.port. Lists are comma separated.
+
+Secrets can instead be read from a file by setting the field of the same name
+ending in File, e.g. DiscordKeyFile. The file wins over the secret itself.
+*/
+
+// EnvPrefix starts the name of every environment variable
+const EnvPrefix = "EBR_"
+
+// Redacted replaces secrets in the output of config show
+const Redacted = "REDACTED"
+
+// field is one setting in Config
+type field struct {
+	// Name is the setting as written in the config file, e.g. "Server.Port"
+	Name  string
+	Env   string
+	Flag  string
+	value reflect.Value
+	// secret fields are redacted and can be read from a file
+	secret bool
+}
+
+// fields lists every setting in conf, with values that can be set
+func fields(conf *Config) []field {
+	var all []field
+
+	var walk func(v reflect.Value, section string)
+	walk = func(v reflect.Value, section string) {
+		for i := 0; i < v.NumField(); i++ {
+			sf := v.Type().Field(i)
+			fv := v.Field(i)
+
+			if fv.Kind() == reflect.Struct && fv.Type() != reflect.TypeOf(time.Time{}) {
+				walk(fv, sf.Name)
+				continue
+			}
+
+			f := field{
+				Name:   sf.Name,
+				Env:    EnvPrefix + strings.ToUpper(snakeCase(sf.Name)),
+				Flag:   strings.ReplaceAll(snakeCase(sf.Name), "_", "-"),
+				value:  fv,
+				secret: sf.Tag.Get("config") == "secret",
+			}
+			if section != "" {
+				f.Name = section + "." + f.Name
+				f.Env = EnvPrefix + strings.ToUpper(section) + "_" + strings.TrimPrefix(f.Env, EnvPrefix)
+				f.Flag = strings.ToLower(section) + "." + f.Flag
+			}
+			all = append(all, f)
+		}
+	}
+	walk(reflect.ValueOf(conf).Elem(), "")
+
+	return all
+}
+
+// snakeCase splits a field name into lower case words, e.g. TLSCertFile is tls_cert_file
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := unicode.IsLower(runes[i-1])
+			// The last capital of an acronym starts the next word, e.g. the C in TLSCert
+			endOfAcronym := unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || endOfAcronym {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// setValue parses s into v according to v's type
+func setValue(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(d))
+		return nil
+	case time.Time:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		// Maps are written key=value, e.g. "585871423394185226=2,585871423394185227=3"
+		m := make(map[string]int)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, not %q", item)
+			}
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return err
+			}
+			m[strings.TrimSpace(key)] = n
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("can't set a %s", v.Type())
+	}
+	return nil
+}
+
+// Overrides are settings given on the command line, by field name
+type Overrides map[string]string
+
+// RegisterFlags adds a flag to fs for every setting.
+// The values are only checked when the config is loaded with them.
+func RegisterFlags(fs *flag.FlagSet) Overrides {
+	o := make(Overrides)
+	var conf Config
+	for _, f := range fields(&conf) {
+		name := f.Name
+		fs.Func(f.Flag, "overrides "+name+" in the config file", func(s string) error {
+			o[name] = s
+			return nil
+		})
+	}
+	return o
+}
+
+// applyOverrides sets fields from the environment and then from o, returning a Problem for each bad value.
+// sources maps each field which was overridden to the variable or flag it came from.
+func applyOverrides(conf *Config, o Overrides) (sources map[string]string, problems []Problem) {
+	sources = make(map[string]string)
+	for _, f := range fields(conf) {
+		if s, ok := os.LookupEnv(f.Env); ok {
+			sources[f.Name] = f.Env
+			if err := setValue(f.value, s); err != nil {
+				problems = append(problems, Problem{Field: f.Name, Message: fmt.Sprintf("invalid %s: %v", f.Env, err)})
+			}
+		}
+		if s, ok := o[f.Name]; ok {
+			sources[f.Name] = "-" + f.Flag
+			if err := setValue(f.value, s); err != nil {
+				problems = append(problems, Problem{Field: f.Name, Message: fmt.Sprintf("invalid -%s: %v", f.Flag, err)})
+			}
+		}
+	}
+	return sources, problems
+}
+
+// readSecretFiles sets each secret whose File field is set from that file.
+// Lists, like SessionKeys, have one item per line.
+func readSecretFiles(conf *Config) []Problem {
+	var problems []Problem
+
+	byName := make(map[string]field)
+	all := fields(conf)
+	for _, f := range all {
+		byName[f.Name] = f
+	}
+
+	for _, f := range all {
+		if !f.secret {
+			continue
+		}
+		fileField, ok := byName[f.Name+"File"]
+		if !ok || fileField.value.String() == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(fileField.value.String())
+		if err != nil {
+			problems = append(problems, Problem{Field: fileField.Name, Message: err.Error()})
+			continue
+		}
+		contents := strings.TrimSpace(string(data))
+		if f.value.Kind() == reflect.Slice {
+			// Set the lines directly, a random key may well contain a comma
+			var list []string
+			for _, line := range strings.Split(contents, "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					list = append(list, line)
+				}
+			}
+			f.value.Set(reflect.ValueOf(list))
+			continue
+		}
+		if err := setValue(f.value, contents); err != nil {
+			problems = append(problems, Problem{Field: fileField.Name, Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// Redact returns a copy of conf with every secret replaced, for showing to people
+func (conf Config) Redact() Config {
+	// fields sets through a pointer, so the slices need copying to leave conf alone
+	conf.SessionKeys = append([]string(nil), conf.SessionKeys...)
+
+	for _, f := range fields(&conf) {
+		if !f.secret {
+			continue
+		}
+		switch f.value.Kind() {
+		case reflect.String:
+			if f.value.String() != "" {
+				f.value.SetString(Redacted)
+			}
+		case reflect.Slice:
+			for i := 0; i < f.value.Len(); i++ {
+				f.value.Index(i).SetString(Redacted)
+			}
+		}
+	}
+	return conf
+}
+
+// Describe lists every setting with its environment variable and flag, for help output
+func Describe() []string {
+	var conf Config
+	var lines []string
+	for _, f := range fields(&conf) {
+		lines = append(lines, fmt.Sprintf("%-28s %-34s -%s", f.Name, f.Env, f.Flag))
+	}
+	return lines
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"reflect"
+	"time"
+)
+
+// Reloadable are the settings which can be changed while the server is running.
+// Changes to anything else are only picked up after a restart.
+var Reloadable = map[string]bool{
+	"ElectionName":          true,
+	"StartTime":             true,
+	"EndTime":               true,
+	"ShutdownTimeout":       true,
+	"Server.TrustedProxies": true,
+	"RateLimit.VoterRate":   true,
+	"RateLimit.VoterBurst":  true,
+	"RateLimit.IPRate":      true,
+	"RateLimit.IPBurst":     true,
+
+	"RateLimit.MaxVotesPerCandidate":   true,
+	"RateLimit.MaxVotesPerTransaction": true,
+}
+
+// Reload works out what to do with a changed config.
+// It returns current with the Reloadable settings taken from next, the names of those which changed,
+// and the names of any other settings which changed and will need a restart.
+func Reload(current Config, next Config) (reloaded Config, applied []string, needRestart []string) {
+	reloaded = current
+	// fields sets through a pointer, so share nothing with current
+	reloaded.SessionKeys = append([]string(nil), current.SessionKeys...)
+	reloaded.Server.TrustedProxies = append([]string(nil), current.Server.TrustedProxies...)
+
+	nextFields := fields(&next)
+	for i, f := range fields(&reloaded) {
+		nf := nextFields[i]
+		if sameValue(f.value, nf.value) {
+			continue
+		}
+
+		if Reloadable[f.Name] {
+			f.value.Set(nf.value)
+			applied = append(applied, f.Name)
+		} else {
+			needRestart = append(needRestart, f.Name)
+		}
+	}
+	return reloaded, applied, needRestart
+}
+
+// sameValue compares two settings. Times are equal if they're the same instant, even in different locations,
+// and an empty list or map is the same as none.
+func sameValue(a reflect.Value, b reflect.Value) bool {
+	if t, ok := a.Interface().(time.Time); ok {
+		return t.Equal(b.Interface().(time.Time))
+	}
+	if (a.Kind() == reflect.Slice || a.Kind() == reflect.Map) && a.Len() == 0 && b.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
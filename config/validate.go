@@ -0,0 +1,301 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Problem is one thing wrong with a config
+type Problem struct {
+	// Field is the setting's name as written in the file, e.g. "Server.Port"
+	Field string
+	// Line is where Field is set in the file, or 0 if it isn't set there
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Line > 0 && p.Field != "":
+		return fmt.Sprintf("line %d: %s: %s", p.Line, p.Field, p.Message)
+	case p.Field != "":
+		return fmt.Sprintf("%s: %s", p.Field, p.Message)
+	case p.Line > 0:
+		return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+	}
+	return p.Message
+}
+
+// ValidationError lists everything wrong with a config file, so it can all be fixed in one go
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{fmt.Sprintf("Invalid config %s, %d problems:", e.File, len(e.Problems))}
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks the settings make sense together and returns every problem found.
+// The problems don't have line numbers, LoadConfig fills those in.
+func Validate(conf Config) []Problem {
+	var problems []Problem
+	add := func(field string, format string, args ...interface{}) {
+		problems = append(problems, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if conf.DatabaseFile == "" {
+		add("DatabaseFile", "must be set")
+	} else if !strings.HasSuffix(conf.DatabaseFile, ".db") {
+		add("DatabaseFile", "must end with .db")
+	}
+
+	if conf.CandidatesFile != "" {
+		switch strings.ToLower(filepath.Ext(conf.CandidatesFile)) {
+		case ".toml", ".json", ".csv":
+		default:
+			add("CandidatesFile", "must be a .toml, .json or .csv file")
+		}
+	}
+
+	if conf.StartTime.IsZero() {
+		add("StartTime", "must be set, e.g. 2030-07-05T05:45:00Z")
+	}
+	if conf.EndTime.IsZero() {
+		add("EndTime", "must be set, e.g. 2030-07-06T05:45:00Z")
+	}
+	if !conf.StartTime.IsZero() && !conf.EndTime.IsZero() && !conf.EndTime.After(conf.StartTime) {
+		add("EndTime", "must be after StartTime (%s)", conf.StartTime.Format(time.RFC3339))
+	}
+
+	if conf.ShutdownTimeout < 0 {
+		add("ShutdownTimeout", "cannot be negative")
+	}
+
+	if len(conf.SessionKeys) == 0 {
+		add("SessionKeys", "needs at least one key")
+	}
+	for i, key := range conf.SessionKeys {
+		if len(key) < 16 {
+			add("SessionKeys", "key %d is too short, keys need at least 16 characters", i+1)
+		}
+	}
+
+	switch conf.LoginMode {
+	case "discord", "":
+		if conf.GuildID == "" {
+			add("GuildID", "must be set when LoginMode is discord")
+		}
+		if conf.OAuth.ClientID == "" {
+			add("OAuth.ClientID", "must be set when LoginMode is discord")
+		}
+		if conf.OAuth.ClientSecret == "" {
+			add("OAuth.ClientSecret", "must be set when LoginMode is discord")
+		}
+		if conf.OAuth.RedirectURL == "" {
+			add("OAuth.RedirectURL", "must be set when LoginMode is discord")
+		}
+	case "token":
+	default:
+		add("LoginMode", "must be discord or token, not %q", conf.LoginMode)
+	}
+	if conf.TokenOnFirstVisit && conf.LoginMode != "token" {
+		add("TokenOnFirstVisit", "only works when LoginMode is token")
+	}
+
+	if conf.Server.Port < 1 || conf.Server.Port > 65535 {
+		add("Server.Port", "must be between 1 and 65535, not %d", conf.Server.Port)
+	}
+	if conf.Server.ReadTimeout < 0 {
+		add("Server.ReadTimeout", "cannot be negative")
+	}
+	if conf.Server.WriteTimeout < 0 {
+		add("Server.WriteTimeout", "cannot be negative")
+	}
+	if conf.Server.IdleTimeout < 0 {
+		add("Server.IdleTimeout", "cannot be negative")
+	}
+	if conf.Server.TLSCertFile != "" && conf.Server.TLSKeyFile == "" {
+		add("Server.TLSKeyFile", "must be set when TLSCertFile is")
+	}
+	if conf.Server.TLSKeyFile != "" && conf.Server.TLSCertFile == "" {
+		add("Server.TLSCertFile", "must be set when TLSKeyFile is")
+	}
+	for _, proxy := range conf.Server.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				add("Server.TrustedProxies", "%q is not an IP address or CIDR range", proxy)
+			}
+		}
+	}
+
+	if conf.RateLimit.VoterRate < 0 {
+		add("RateLimit.VoterRate", "cannot be negative")
+	}
+	if conf.RateLimit.VoterRate > 0 && conf.RateLimit.VoterBurst < 1 {
+		add("RateLimit.VoterBurst", "must be at least 1 when VoterRate is set")
+	}
+	if conf.RateLimit.IPRate < 0 {
+		add("RateLimit.IPRate", "cannot be negative")
+	}
+	if conf.RateLimit.IPRate > 0 && conf.RateLimit.IPBurst < 1 {
+		add("RateLimit.IPBurst", "must be at least 1 when IPRate is set")
+	}
+	if conf.RateLimit.MaxVotesPerCandidate < 1 {
+		add("RateLimit.MaxVotesPerCandidate", "must be at least 1")
+	}
+	if conf.RateLimit.MaxVotesPerTransaction < conf.RateLimit.MaxVotesPerCandidate {
+		add("RateLimit.MaxVotesPerTransaction", "must be at least MaxVotesPerCandidate")
+	}
+
+	if conf.Discord.EmojiDir == "" || !filepath.IsLocal(conf.Discord.EmojiDir) {
+		add("Discord.EmojiDir", "must be a directory inside ImageDir, not %q", conf.Discord.EmojiDir)
+	}
+	if !isWebURL(conf.Discord.CDNURL) {
+		add("Discord.CDNURL", "must be an http or https URL, not %q", conf.Discord.CDNURL)
+	}
+	if conf.Discord.Downloads < 1 {
+		add("Discord.Downloads", "must be at least 1")
+	}
+	if conf.Discord.DownloadTimeout <= 0 {
+		add("Discord.DownloadTimeout", "must be more than 0")
+	}
+	if conf.Discord.DownloadRetries < 0 {
+		add("Discord.DownloadRetries", "cannot be negative")
+	}
+	if conf.Discord.MaxEmojiSize < 1 {
+		add("Discord.MaxEmojiSize", "must be at least 1")
+	}
+	if conf.Discord.AnnounceChannel != "" && conf.DiscordKey == "" {
+		add("DiscordKey", "must be set when Discord.AnnounceChannel is")
+	}
+	if conf.Discord.Voting && conf.DiscordKey == "" {
+		add("DiscordKey", "must be set when Discord.Voting is on")
+	}
+	if conf.Discord.Voting && conf.GuildID == "" {
+		add("GuildID", "must be set when Discord.Voting is on")
+	}
+	if conf.Discord.Crown && conf.DiscordKey == "" {
+		add("DiscordKey", "must be set when Discord.Crown is on")
+	}
+	if conf.Discord.Crown && conf.GuildID == "" {
+		add("GuildID", "must be set when Discord.Crown is on")
+	}
+	if conf.Discord.Crown && conf.Discord.PinResults && conf.Discord.AnnounceChannel == "" {
+		add("Discord.AnnounceChannel", "must be set to pin the results when Discord.Crown is on")
+	}
+	if !emojiName.MatchString(conf.Discord.ChampionPrefix) {
+		add("Discord.ChampionPrefix", "can only contain letters, numbers and underscores")
+	}
+	switch conf.Discord.Losers {
+	case "keep", "remove":
+	case "archive":
+		if conf.Discord.ArchivePrefix == "" {
+			add("Discord.ArchivePrefix", "must be set when Losers is archive")
+		}
+	default:
+		add("Discord.Losers", "must be keep, archive or remove, not %q", conf.Discord.Losers)
+	}
+	if !emojiName.MatchString(conf.Discord.ArchivePrefix) {
+		add("Discord.ArchivePrefix", "can only contain letters, numbers and underscores")
+	}
+	if conf.Discord.TopVoters < 0 {
+		add("Discord.TopVoters", "cannot be negative")
+	}
+	if conf.Discord.VoteURL != "" && !isWebURL(conf.Discord.VoteURL) {
+		add("Discord.VoteURL", "must be an http or https URL, not %q", conf.Discord.VoteURL)
+	}
+	if len(conf.Discord.RoleWeights) > 0 && conf.DiscordKey == "" {
+		add("DiscordKey", "must be set to look up the roles in Discord.RoleWeights")
+	}
+	if len(conf.Discord.RoleWeights) > 0 && conf.GuildID == "" {
+		add("GuildID", "must be set to look up the roles in Discord.RoleWeights")
+	}
+	roles := make([]string, 0, len(conf.Discord.RoleWeights))
+	for role := range conf.Discord.RoleWeights {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		if !roleID.MatchString(role) {
+			add("Discord.RoleWeights", "must be keyed by role ID, not %q", role)
+		}
+		if weight := conf.Discord.RoleWeights[role]; weight < 1 {
+			add("Discord.RoleWeights", "weight for role %s must be at least 1, not %d", role, weight)
+		}
+	}
+
+	return problems
+}
+
+// roleID matches the ID of a Discord role
+var roleID = regexp.MustCompile(`^[0-9]+$`)
+
+// emojiName matches what Discord allows in the name of an emoji
+var emojiName = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// isWebURL checks s is an absolute http or https URL
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// keyLines finds the line each key is set on, keyed by its dotted name e.g. "Server.Port".
+// It only understands the simple [Table] and key = value lines used in our config files.
+func keyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	table := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "["):
+			table = strings.Trim(line, "[] ")
+			lines[table] = n
+		case strings.Contains(line, "="):
+			key := strings.Trim(strings.TrimSpace(line[:strings.Index(line, "=")]), `"`)
+			if table != "" {
+				key = table + "." + key
+			}
+			lines[key] = n
+		}
+	}
+	return lines
+}
+
+// findLine looks up a field in the map from keyLines. TOML keys are matched without case, like the decoder does.
+func findLine(lines map[string]int, field string) int {
+	if n, ok := lines[field]; ok {
+		return n
+	}
+	for key, n := range lines {
+		if strings.EqualFold(key, field) {
+			return n
+		}
+	}
+	return 0
+}
+
+// sortProblems orders problems by line, with problems for unset fields at the end
+func sortProblems(problems []Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		if (problems[i].Line == 0) != (problems[j].Line == 0) {
+			return problems[j].Line == 0
+		}
+		return problems[i].Line < problems[j].Line
+	})
+}
@@ -0,0 +1,241 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Dump is a complete copy of the database, used for backups and moving an election between servers
+type Dump struct {
+	Candidates     map[string]bool
+	CandidateInfo  map[string]CandidateInfo
+	Votes          Votes
+	Transactions   map[int]Transaction
+	Eliminations   []Elimination
+	RedeemedTokens []string
+}
+
+// AddCandidate adds a single candidate with no votes
+func (s *Store) AddCandidate(candidate string) error {
+	if candidate == "" {
+		return fmt.Errorf("Candidate name cannot be empty")
+	}
+	return s.update("AddCandidate", func(tx *bolt.Tx) error {
+		bCAN := tx.Bucket([]byte("CANDIDATES"))
+		bVOT := tx.Bucket([]byte("VOTES"))
+
+		if bCAN.Get([]byte(candidate)) != nil {
+			return fmt.Errorf("Cannot add %s, candidate already exists", candidate)
+		}
+		if err := bCAN.Put([]byte(candidate), booltobyte(true)); err != nil {
+			return err
+		}
+		return bVOT.Put([]byte(candidate), itob(0))
+	})
+}
+
+// RemoveCandidate deletes a candidate entirely.
+// Only candidates nobody has voted for can be removed, otherwise the totals wouldn't add up.
+func (s *Store) RemoveCandidate(candidate string) error {
+	return s.update("RemoveCandidate", func(tx *bolt.Tx) error {
+		bCAN := tx.Bucket([]byte("CANDIDATES"))
+		bVOT := tx.Bucket([]byte("VOTES"))
+
+		if bCAN.Get([]byte(candidate)) == nil {
+			return fmt.Errorf("Cannot remove %s, candidate not found", candidate)
+		}
+		if v := bVOT.Get([]byte(candidate)); v != nil && btoi(v) != 0 {
+			return fmt.Errorf("Cannot remove %s, candidate has %d votes. Eliminate them instead", candidate, btoi(v))
+		}
+		if err := bCAN.Delete([]byte(candidate)); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte("CANDIDATE_INFO")).Delete([]byte(candidate)); err != nil {
+			return err
+		}
+		return bVOT.Delete([]byte(candidate))
+	})
+}
+
+// Export writes a Dump of the whole database to w as JSON
+func (s *Store) Export(w io.Writer) error {
+	d := Dump{
+		Candidates:    make(map[string]bool),
+		CandidateInfo: make(map[string]CandidateInfo),
+		Votes:         s.GetVotes(),
+		Transactions:  s.GetAllTransactions(),
+		Eliminations:  s.GetEliminations(),
+	}
+	for _, can := range s.GetCandidates(true) {
+		if !can.CandidateInfo.isEmpty() {
+			d.CandidateInfo[can.ID] = can.CandidateInfo
+		}
+	}
+
+	err := s.view("Export", func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("CANDIDATES")).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			d.Candidates[string(k)] = bytetobool(v)
+		}
+
+		c = tx.Bucket([]byte("REDEEMED_TOKENS")).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			d.RedeemedTokens = append(d.RedeemedTokens, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// Import loads a Dump written by Export. The database must not have any candidates yet.
+func (s *Store) Import(r io.Reader) error {
+	var d Dump
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return fmt.Errorf("Unable to read dump: %v", err)
+	}
+
+	return s.update("Import", func(tx *bolt.Tx) error {
+		bCAN := tx.Bucket([]byte("CANDIDATES"))
+		bVOT := tx.Bucket([]byte("VOTES"))
+		bTRN := tx.Bucket([]byte("TRANSACTIONS"))
+		bELM := tx.Bucket([]byte("ELIMINATIONS"))
+		bTOK := tx.Bucket([]byte("REDEEMED_TOKENS"))
+
+		if k, _ := bCAN.Cursor().First(); k != nil {
+			return fmt.Errorf("Cannot import into a database which already has candidates")
+		}
+
+		for can, active := range d.Candidates {
+			bCAN.Put([]byte(can), booltobyte(active))
+		}
+		for can, info := range d.CandidateInfo {
+			buf, err := json.Marshal(info)
+			if err != nil {
+				return err
+			}
+			tx.Bucket([]byte("CANDIDATE_INFO")).Put([]byte(can), buf)
+		}
+		for can, votes := range d.Votes {
+			bVOT.Put([]byte(can), itob(votes))
+		}
+
+		maxID := 0
+		for id, t := range d.Transactions {
+			buf, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			bTRN.Put(itob(id), buf)
+			if id > maxID {
+				maxID = id
+			}
+		}
+		// New transactions must carry on from the highest imported ID
+		if err := bTRN.SetSequence(uint64(maxID)); err != nil {
+			return err
+		}
+
+		for _, e := range d.Eliminations {
+			buf, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			bELM.Put(itob(e.Round), buf)
+		}
+		for _, nonce := range d.RedeemedTokens {
+			bTOK.Put([]byte(nonce), booltobyte(true))
+		}
+		return nil
+	})
+}
+
+// CheckConsistency cross-checks the buckets against each other and returns every problem found
+func (s *Store) CheckConsistency() []error {
+	var problems []error
+
+	if err := s.Verify(); err != nil {
+		return []error{err}
+	}
+
+	all := s.GetCandidateList(true)
+	active := make(map[string]bool)
+	for _, can := range s.GetCandidateList(false) {
+		active[can] = true
+	}
+	totals := s.GetVotes()
+
+	// Every candidate needs a vote total and every vote total needs a candidate
+	known := make(map[string]bool)
+	for _, can := range all {
+		known[can] = true
+		if _, ok := totals[can]; !ok {
+			problems = append(problems, fmt.Errorf("candidate %s has no vote total", can))
+		}
+	}
+	for can := range totals {
+		if !known[can] {
+			problems = append(problems, fmt.Errorf("vote total for unknown candidate %s", can))
+		}
+	}
+
+	for _, can := range s.GetCandidates(true) {
+		if can.Image == "" {
+			continue
+		}
+		if strings.HasPrefix(can.Image, "/") || strings.Contains(can.Image, "..") {
+			problems = append(problems, fmt.Errorf("candidate %s has an image outside the image directory: %s", can.ID, can.Image))
+		}
+	}
+	s.view("CheckConsistency", func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("CANDIDATE_INFO")).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !known[string(k)] {
+				problems = append(problems, fmt.Errorf("display info for unknown candidate %s", k))
+			}
+		}
+		return nil
+	})
+
+	// The totals should be the sum of all the transactions, weighted
+	sums := make(Votes)
+	for id, t := range s.GetAllTransactions() {
+		if t.Weight < 0 {
+			problems = append(problems, fmt.Errorf("transaction %d has a negative weight %d", id, t.Weight))
+		}
+		for can, votes := range t.Weighted() {
+			if !known[can] {
+				problems = append(problems, fmt.Errorf("transaction %d votes for unknown candidate %s", id, can))
+			}
+			sums[can] += votes
+		}
+	}
+	for _, can := range all {
+		if sums[can] != totals[can] {
+			problems = append(problems, fmt.Errorf("candidate %s has %d votes but transactions add up to %d", can, totals[can], sums[can]))
+		}
+	}
+
+	// Candidates eliminated in a round must no longer be active
+	for i, e := range s.GetEliminations() {
+		if e.Round != i+1 {
+			problems = append(problems, fmt.Errorf("elimination history skips from round %d to %d", i, e.Round))
+		}
+		if active[e.Candidate] {
+			problems = append(problems, fmt.Errorf("%s was eliminated in round %d but is still active", e.Candidate, e.Round))
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+	return problems
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// CandidateInfo is how a candidate is shown to voters.
+// It is stored in CANDIDATE_INFO, keyed by the candidate ID used everywhere else.
+type CandidateInfo struct {
+	// Name is shown instead of the ID when set
+	Name string `json:",omitempty"`
+	// Image is the path of the candidate's picture inside the image directory, e.g. "battle/1234.gif"
+	Image string `json:",omitempty"`
+	// Tags group candidates, e.g. "animated" or "custom"
+	Tags []string `json:",omitempty"`
+}
+
+func (info CandidateInfo) isEmpty() bool {
+	return info.Name == "" && info.Image == "" && len(info.Tags) == 0
+}
+
+// Candidate is everything known about a candidate
+type Candidate struct {
+	ID string
+	CandidateInfo
+	Active bool
+}
+
+// DisplayName returns the candidate's name, or their ID if they don't have one
+func (c Candidate) DisplayName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.ID
+}
+
+// SetCandidateInfo sets the display name and image of an existing candidate
+func (s *Store) SetCandidateInfo(candidate string, info CandidateInfo) error {
+	return s.update("SetCandidateInfo", func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("CANDIDATES")).Get([]byte(candidate)) == nil {
+			return fmt.Errorf("Cannot update %s, candidate not found", candidate)
+		}
+
+		buf, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("CANDIDATE_INFO")).Put([]byte(candidate), buf)
+	})
+}
+
+// GetCandidates returns every candidate ordered by ID.
+// if includeEliminatedCandidates is false, only active candidates will be returned
+func (s *Store) GetCandidates(includeEliminatedCandidates bool) []Candidate {
+	var candidates []Candidate
+	s.view("GetCandidates", func(tx *bolt.Tx) error {
+		bINF := tx.Bucket([]byte("CANDIDATE_INFO"))
+
+		c := tx.Bucket([]byte("CANDIDATES")).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !includeEliminatedCandidates && !bytetobool(v) {
+				continue
+			}
+
+			can := Candidate{ID: string(k), Active: bytetobool(v)}
+			if info := bINF.Get(k); info != nil {
+				if err := json.Unmarshal(info, &can.CandidateInfo); err != nil {
+					return fmt.Errorf("Unable to unmarshal info for %s", can.ID)
+				}
+			}
+			candidates = append(candidates, can)
+		}
+		return nil
+	})
+	return candidates
+}
+
+// UpsertCandidates adds the candidates which don't exist yet and updates the info of those which do,
+// keeping their votes and whether they are still in the running. It returns how many were added.
+func (s *Store) UpsertCandidates(candidates []Candidate) (int, error) {
+	added := 0
+	err := s.update("UpsertCandidates", func(tx *bolt.Tx) error {
+		bCAN := tx.Bucket([]byte("CANDIDATES"))
+		bINF := tx.Bucket([]byte("CANDIDATE_INFO"))
+		bVOT := tx.Bucket([]byte("VOTES"))
+
+		seen := make(map[string]bool)
+		for _, can := range candidates {
+			if can.ID == "" {
+				return fmt.Errorf("Candidate ID cannot be empty")
+			}
+			if seen[can.ID] {
+				return fmt.Errorf("Cannot add %s, candidate appears twice", can.ID)
+			}
+			seen[can.ID] = true
+
+			if bCAN.Get([]byte(can.ID)) == nil {
+				bCAN.Put([]byte(can.ID), booltobyte(true))
+				bVOT.Put([]byte(can.ID), itob(0))
+				added++
+			}
+
+			if can.CandidateInfo.isEmpty() {
+				if err := bINF.Delete([]byte(can.ID)); err != nil {
+					return err
+				}
+				continue
+			}
+			buf, err := json.Marshal(can.CandidateInfo)
+			if err != nil {
+				return err
+			}
+			if err := bINF.Put([]byte(can.ID), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
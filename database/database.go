@@ -8,11 +8,15 @@ import (
 	"encoding/binary"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -24,13 +28,120 @@ type Transaction struct {
 	UserID string `json:"Id"`
 	// TimeStamp TimeDate
 	Votes Votes `json:"Votes"`
+	// IP is the address the transaction was sent from
+	IP string `json:"IP,omitempty"`
+	// RequestID ties the transaction to the log lines of the request which sent it
+	RequestID string `json:"RequestID,omitempty"`
+	// Weight multiplies every vote in the transaction, from the voter's roles on Discord.
+	// 0 is the same as 1, for transactions stored before votes were weighted.
+	Weight int `json:"Weight,omitempty"`
+}
+
+// Multiplier is how much each vote in the transaction counts for
+func (t Transaction) Multiplier() int {
+	if t.Weight == 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// CheckLimits rejects a transaction carrying more than perCandidate votes for any one candidate,
+// or more than perTransaction votes in all, or votes which aren't positive. These errors are
+// a *CandidateError with ErrInvalidVoteCount, naming the candidate which went over.
+// A transaction with no votes, or for more than candidates candidates, is rejected with ErrInvalidVoteCount
+// before any of its votes are looked at.
+func (t Transaction) CheckLimits(perCandidate int, perTransaction int, candidates int) error {
+	if err := t.checkSize(candidates); err != nil {
+		return err
+	}
+
+	// Go through the candidates in order, so the same transaction always blames the same one
+	names := make([]string, 0, len(t.Votes))
+	for can := range t.Votes {
+		names = append(names, can)
+	}
+	sort.Strings(names)
+
+	total := 0
+	for _, can := range names {
+		votes := t.Votes[can]
+		if votes <= 0 || votes > perCandidate {
+			return &CandidateError{Candidate: can, Reason: ErrInvalidVoteCount, RequestID: t.RequestID}
+		}
+		// Both are at most perCandidate, so this can't overflow
+		total += votes
+		if total > perTransaction {
+			return &CandidateError{Candidate: can, Reason: ErrInvalidVoteCount, RequestID: t.RequestID}
+		}
+	}
+	return nil
+}
+
+// checkSize rejects a transaction with no votes, or votes for more than candidates candidates
+func (t Transaction) checkSize(candidates int) error {
+	if len(t.Votes) == 0 {
+		return fmt.Errorf("%w: the transaction has no votes", ErrInvalidVoteCount)
+	}
+	if len(t.Votes) > candidates {
+		return fmt.Errorf("%w: the transaction votes for %d candidates, there are %d", ErrInvalidVoteCount, len(t.Votes), candidates)
+	}
+	return nil
+}
+
+// addVotes returns total plus votes weighted by weight, and false if that doesn't fit in an int.
+// votes and weight must not be negative.
+func addVotes(total int, votes int, weight int) (int, bool) {
+	if weight != 0 && votes > (math.MaxInt-total)/weight {
+		return total, false
+	}
+	return total + votes*weight, true
+}
+
+// Weighted returns the transaction's votes multiplied by its weight, as they count towards the totals
+func (t Transaction) Weighted() Votes {
+	weighted := make(Votes, len(t.Votes))
+	for can, votes := range t.Votes {
+		weighted[can] = votes * t.Multiplier()
+	}
+	return weighted
 }
 
 type Store struct {
-	db *bolt.DB
+	db      *bolt.DB
+	observe func(op string, d time.Duration)
+}
+
+// SetObserver registers a function which is told how long each database transaction took.
+// op is the name of the Store method which ran the transaction.
+func (s *Store) SetObserver(observe func(op string, d time.Duration)) {
+	s.observe = observe
+}
+
+// update runs fn in a read-write transaction, timing it if an observer is set
+func (s *Store) update(op string, fn func(*bolt.Tx) error) error {
+	start := time.Now()
+	err := s.db.Update(fn)
+	if s.observe != nil {
+		s.observe(op, time.Since(start))
+	}
+	return err
+}
+
+// view runs fn in a read-only transaction, timing it if an observer is set
+func (s *Store) view(op string, fn func(*bolt.Tx) error) error {
+	start := time.Now()
+	err := s.db.View(fn)
+	if s.observe != nil {
+		s.observe(op, time.Since(start))
+	}
+	return err
 }
 
-var expectedBuckets = [...]string{"TRANSACTIONS", "VOTES", "CANDIDATES"}
+var expectedBuckets = [...]string{"TRANSACTIONS", "VOTES", "CANDIDATES", "CANDIDATE_INFO", "REDEEMED_TOKENS", "ELIMINATIONS"}
+
+// originalBuckets is how many of expectedBuckets every database has had from the start.
+// Databases made before the rest were added are brought up to date by Migrate.
+const originalBuckets = 3
 
 // itob returns an 8-byte big endian representation of v.
 func itob(v int) []byte {
@@ -55,24 +166,38 @@ func bytetobool(b []byte) bool {
 	return int(b[0]) == 1
 }
 
-// OpenDB loads a database and verifies that it contains the expected buckets
+// verifyBuckets checks that all the expected buckets exist
+func verifyBuckets(tx *bolt.Tx) error {
+	return checkBuckets(tx, expectedBuckets[:])
+}
+
+// checkBuckets checks that each of the named buckets exists
+func checkBuckets(tx *bolt.Tx, names []string) error {
+	for _, v := range names {
+		if nil == tx.Bucket([]byte(v)) {
+			return fmt.Errorf("%s bucket not found", v)
+		}
+	}
+	return nil
+}
+
+// OpenDB loads a database and verifies that it contains the original buckets.
+// Call Migrate before using it, in case it was made by an older version.
 func OpenDB(filename string) (*Store, error) {
-	db, err := bolt.Open("test.db", 0600, nil)
+	// bolt.Open would quietly create an empty file
+	if _, err := os.Stat(filename); err != nil {
+		return nil, fmt.Errorf("could not open db file %s: %v", filename, err)
+	}
+
+	// Only one process can have the file open, so don't wait forever for the lock
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
 	if err != nil {
 		return nil, fmt.Errorf("could not open db file %s: %v", filename, err)
 	}
 
 	// Check that DB state is correct
 	err = db.View(func(tx *bolt.Tx) error {
-
-		// Check that exected buckets exist
-		for _, v := range expectedBuckets {
-			if nil == tx.Bucket([]byte(v)) {
-				return fmt.Errorf("%s bucket not found", v)
-			}
-		}
-
-		return nil
+		return checkBuckets(tx, expectedBuckets[:originalBuckets])
 	})
 
 	if err != nil {
@@ -125,24 +250,67 @@ func CreateOrOverwriteDB(filename string) (*Store, error) {
 	return &Store{db: db}, nil
 }
 
+// Verify checks that the database is open and contains the expected buckets
+func (s *Store) Verify() error {
+	return s.view("Verify", verifyBuckets)
+}
+
+// Migrate creates the buckets which a database made by an older version is missing,
+// and returns their names. It does nothing to a database which is up to date.
+func (s *Store) Migrate() ([]string, error) {
+	var created []string
+	err := s.update("Migrate", func(tx *bolt.Tx) error {
+		for _, v := range expectedBuckets[originalBuckets:] {
+			if tx.Bucket([]byte(v)) != nil {
+				continue
+			}
+			if _, err := tx.CreateBucket([]byte(v)); err != nil {
+				return fmt.Errorf("Could not create %s bucket: %v", v, err)
+			}
+			created = append(created, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
 // Close the database connection
 func (s *Store) Close() {
 	s.db.Close()
 }
 
-// InitializeCandidates populates the CANDIDATES and VOTES buckets
-// WARNING: calling this on an already initialized database will not cause any errors
-func (s *Store) InitializeCandidates(candidates []string) {
-	s.db.Update(func(tx *bolt.Tx) error {
+// InitializeCandidates populates the CANDIDATES, CANDIDATE_INFO and VOTES buckets, e.g. from a manifest.
+// Nothing is added if any of the candidates already exist or appear twice.
+func (s *Store) InitializeCandidates(candidates []Candidate) error {
+	return s.update("InitializeCandidates", func(tx *bolt.Tx) error {
 		bCAN := tx.Bucket([]byte("CANDIDATES"))
+		bINF := tx.Bucket([]byte("CANDIDATE_INFO"))
 		bVOT := tx.Bucket([]byte("VOTES"))
 
 		for _, can := range candidates {
+			if can.ID == "" {
+				return fmt.Errorf("Candidate ID cannot be empty")
+			}
+			if bCAN.Get([]byte(can.ID)) != nil {
+				return fmt.Errorf("Cannot add %s, candidate already exists", can.ID)
+			}
+
 			// Add all candidates to the candidate list and set their value to true
-			bCAN.Put([]byte(can), booltobyte(true))
+			bCAN.Put([]byte(can.ID), booltobyte(true))
 
 			// Add all candidates to the vote list and set their number to 0
-			bVOT.Put([]byte(can), itob(0))
+			bVOT.Put([]byte(can.ID), itob(0))
+
+			if !can.CandidateInfo.isEmpty() {
+				buf, err := json.Marshal(can.CandidateInfo)
+				if err != nil {
+					return err
+				}
+				bINF.Put([]byte(can.ID), buf)
+			}
 		}
 		return nil
 	})
@@ -150,35 +318,62 @@ func (s *Store) InitializeCandidates(candidates []string) {
 
 // StoreTransaction saves the transaction to the database
 func (s *Store) StoreTransaction(t Transaction) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+	_, err := s.SubmitTransaction(t)
+	return err
+}
+
+// SubmitTransaction saves the transaction to the database and returns its transaction ID.
+// Each vote adds the transaction's weight to the candidate's total.
+// If any candidate in the transaction is rejected, nothing is stored and a *CandidateError is returned.
+// A transaction with no votes, or more of them than there are candidates, is rejected with ErrInvalidVoteCount.
+func (s *Store) SubmitTransaction(t Transaction) (int, error) {
+	if t.Weight < 0 {
+		return 0, fmt.Errorf("transaction weight cannot be negative: %d", t.Weight)
+	}
+
+	var id uint64
+	err := s.update("SubmitTransaction", func(tx *bolt.Tx) error {
 		// Retrieve buckets
 		bTRN := tx.Bucket([]byte("TRANSACTIONS"))
 		bCAN := tx.Bucket([]byte("CANDIDATES"))
 		bVOT := tx.Bucket([]byte("VOTES"))
 
 		// Increase the total vote count for each candidate voted for
+		// Every key has to be a candidate, which also stops a transaction from being too large to walk
+		if err := t.checkSize(bCAN.Stats().KeyN); err != nil {
+			return err
+		}
+
 		for candidate, voteCount := range t.Votes {
+			if voteCount <= 0 {
+				return &CandidateError{Candidate: candidate, Reason: ErrInvalidVoteCount, RequestID: t.RequestID}
+			}
+
 			// Confirm that the candidate exists and is active
 			candidateStatus := bCAN.Get([]byte(candidate))
 			if candidateStatus == nil {
-				return fmt.Errorf("Transaction contains invalid candidate name: %s", candidate)
+				return &CandidateError{Candidate: candidate, Reason: ErrUnknownCandidate, RequestID: t.RequestID}
 			}
 			if !bytetobool(candidateStatus) {
-				return fmt.Errorf("Cannot vote for eliminated candidate %s", candidate)
+				return &CandidateError{Candidate: candidate, Reason: ErrCandidateEliminated, RequestID: t.RequestID}
 			}
 
 			v := bVOT.Get([]byte(candidate))
 			if v == nil {
-				return fmt.Errorf("Transaction contains invalid candidate name: %s", candidate)
+				return &CandidateError{Candidate: candidate, Reason: ErrUnknownCandidate, RequestID: t.RequestID}
 			}
 
-			bVOT.Put([]byte(candidate), itob(voteCount+btoi(v)))
+			total, ok := addVotes(btoi(v), voteCount, t.Multiplier())
+			if !ok {
+				return &CandidateError{Candidate: candidate, Reason: ErrInvalidVoteCount, RequestID: t.RequestID}
+			}
+			bVOT.Put([]byte(candidate), itob(total))
 		}
 
 		// Generate ID for this trasaction
 		// This returns an error only if the Tx is closed or not writeable.
 		// That can't happen in an Update() call so I ignore the error check.
-		id, _ := bTRN.NextSequence()
+		id, _ = bTRN.NextSequence()
 
 		// Marshal transaction into bytes.
 		buf, err := json.Marshal(t)
@@ -191,12 +386,20 @@ func (s *Store) StoreTransaction(t Transaction) error {
 		// Persist bytes to bucket
 		return bTRN.Put(itob(int(id)), buf)
 	})
+	if err != nil {
+		var ce *CandidateError
+		if t.RequestID != "" && !errors.As(err, &ce) {
+			err = fmt.Errorf("request %s: %w", t.RequestID, err)
+		}
+		return 0, err
+	}
+	return int(id), nil
 }
 
 // EliminateCandidate turns the CANDIDATES(candidate) value to false
 //  so that they can no longer recieve votes
 func (s *Store) EliminateCandidate(candidate string) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+	return s.update("EliminateCandidate", func(tx *bolt.Tx) error {
 		// Retrieve buckets
 		bCAN := tx.Bucket([]byte("CANDIDATES"))
 
@@ -216,11 +419,27 @@ func (s *Store) EliminateCandidate(candidate string) error {
 	})
 }
 
+// RedeemToken records that a one-time login token has been used.
+// It returns false if the token was already redeemed.
+func (s *Store) RedeemToken(nonce string) (bool, error) {
+	redeemed := false
+	err := s.update("RedeemToken", func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("REDEEMED_TOKENS"))
+
+		if b.Get([]byte(nonce)) != nil {
+			return nil
+		}
+		redeemed = true
+		return b.Put([]byte(nonce), booltobyte(true))
+	})
+	return redeemed, err
+}
+
 // GetAllTransactions returns a map of all Transactions by transactionID
 func (s *Store) GetAllTransactions() map[int]Transaction {
 	m := make(map[int]Transaction)
 
-	s.db.View(func(tx *bolt.Tx) error {
+	s.view("GetAllTransactions", func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("TRANSACTIONS"))
 
 		c := b.Cursor()
@@ -244,7 +463,7 @@ func (s *Store) GetAllTransactions() map[int]Transaction {
 func (s *Store) GetVotes() Votes {
 	votes := make(map[string]int)
 
-	s.db.View(func(tx *bolt.Tx) error {
+	s.view("GetVotes", func(tx *bolt.Tx) error {
 		bVOT := tx.Bucket([]byte("VOTES"))
 
 		c := bVOT.Cursor()
@@ -262,7 +481,7 @@ func (s *Store) GetVotes() Votes {
 // if includeEliminatedCandidates is false, only active candidates will be returned
 func (s *Store) GetCandidateList(includeEliminatedCandidates bool) []string {
 	var candidateList []string
-	s.db.View(func(tx *bolt.Tx) error {
+	s.view("GetCandidateList", func(tx *bolt.Tx) error {
 		bCAN := tx.Bucket([]byte("CANDIDATES"))
 		c := bCAN.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
@@ -276,23 +495,24 @@ func (s *Store) GetCandidateList(includeEliminatedCandidates bool) []string {
 }
 
 // ExportAllTransactionsAsCSV will export a complete list of all transactions in CSV format
-// to the writer w
+// to the writer w. The votes for each candidate are weighted, as they count towards the totals.
 func (s *Store) ExportAllTransactionsAsCSV(w io.Writer) {
 	candidates := s.GetCandidateList(true)
 
-	header := append([]string{"Transaction Number", "UserId"}, candidates...)
+	header := append([]string{"Transaction Number", "UserId", "Weight"}, candidates...)
 
 	var data = [][]string{header}
 
 	transactions := s.GetAllTransactions()
 
 	for trasactionNumber, transaction := range transactions {
-		// Start building the line with the Transaction Number and the UserId
-		var line = []string{fmt.Sprintf("%d", trasactionNumber), transaction.UserID}
+		// Start building the line with the Transaction Number, the UserId and the Weight
+		var line = []string{fmt.Sprintf("%d", trasactionNumber), transaction.UserID, fmt.Sprintf("%d", transaction.Multiplier())}
+		votes := transaction.Weighted()
 
 		for _, can := range candidates {
 
-			if val, ok := transaction.Votes[can]; ok {
+			if val, ok := votes[can]; ok {
 				//Candidate found, set votes
 				line = append(line, fmt.Sprintf("%d", val))
 			} else {
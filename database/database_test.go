@@ -1,10 +1,25 @@
 package database
 
 import (
+	"bytes"
+	"errors"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/boltdb/bolt"
 )
 
+// candidatesNamed returns candidates with just an ID
+func candidatesNamed(ids ...string) []Candidate {
+	var candidates []Candidate
+	for _, id := range ids {
+		candidates = append(candidates, Candidate{ID: id})
+	}
+	return candidates
+}
+
 func TestAddTransactions(t *testing.T) {
 	var databaseName string = "TestAddTransactions.db"
 
@@ -13,7 +28,7 @@ func TestAddTransactions(t *testing.T) {
 		t.Errorf("Couldn't create database: %v", err)
 	}
 
-	db1.InitializeCandidates([]string{"ted", "jeb", "hil"})
+	db1.InitializeCandidates(candidatesNamed("ted", "jeb", "hil"))
 
 	t1 := Transaction{
 		UserID: "jonny",
@@ -66,7 +81,7 @@ func TestInvalidTransaction(t *testing.T) {
 		t.Errorf("Couldn't create database: %v", err)
 	}
 
-	db1.InitializeCandidates([]string{"ted", "jeb", "hil"})
+	db1.InitializeCandidates(candidatesNamed("ted", "jeb", "hil"))
 
 	err = db1.StoreTransaction(Transaction{
 		UserID: "jonny",
@@ -127,3 +142,366 @@ func TestInvalidTransaction(t *testing.T) {
 		}
 	}
 }
+
+func TestTransactionErrors(t *testing.T) {
+	var databaseName string = "TestTransactionErrors.db"
+
+	db1, err := CreateOrOverwriteDB(databaseName)
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer db1.Close()
+
+	db1.InitializeCandidates(candidatesNamed("ted", "jeb", "hil"))
+	_ = db1.EliminateCandidate("jeb")
+
+	testData := []struct {
+		votes     Votes
+		candidate string
+		reason    error
+	}{
+		{Votes{"Ron Paul": 1}, "Ron Paul", ErrUnknownCandidate},
+		{Votes{"jeb": 1}, "jeb", ErrCandidateEliminated},
+		{Votes{"hil": -4}, "hil", ErrInvalidVoteCount},
+	}
+
+	for i, d := range testData {
+		_, err := db1.SubmitTransaction(Transaction{UserID: "billy", Votes: d.votes})
+
+		var ce *CandidateError
+		if !errors.As(err, &ce) {
+			t.Errorf("Test[%d] expected a CandidateError, got %v", i, err)
+			continue
+		}
+		if ce.Candidate != d.candidate {
+			t.Errorf("Test[%d] expected candidate %s, got %s", i, d.candidate, ce.Candidate)
+		}
+		if !errors.Is(err, d.reason) {
+			t.Errorf("Test[%d] expected reason %v, got %v", i, d.reason, ce.Reason)
+		}
+	}
+
+	// The request ID is carried through to the error so it can be traced in the logs
+	_, err = db1.SubmitTransaction(Transaction{UserID: "billy", Votes: Votes{"jeb": 1}, RequestID: "f00d"})
+	var ce *CandidateError
+	if !errors.As(err, &ce) || ce.RequestID != "f00d" {
+		t.Errorf("Expected CandidateError for request f00d, got %v", err)
+	}
+
+	id, err := db1.SubmitTransaction(Transaction{UserID: "billy", Votes: Votes{"ted": 2}})
+	if err != nil {
+		t.Errorf("Could not store billy's valid transaction: %v", err)
+	}
+	if id != 1 {
+		t.Errorf("Expected first stored transaction to have ID 1, got %d", id)
+	}
+}
+
+func TestEliminationResults(t *testing.T) {
+	var databaseName string = "TestEliminationResults.db"
+
+	db1, err := CreateOrOverwriteDB(databaseName)
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer db1.Close()
+
+	db1.InitializeCandidates(candidatesNamed("ted", "jeb", "hil"))
+
+	// Round 1
+	db1.StoreTransaction(Transaction{UserID: "jonny", Votes: Votes{"ted": 5, "jeb": 2, "hil": 9}})
+	if e, err := db1.EliminateLowest(1); err != nil || e.Candidate != "jeb" {
+		t.Errorf("Expected jeb to be eliminated in round 1, got %s %v", e.Candidate, err)
+	}
+	if _, err := db1.EliminateLowest(1); err == nil {
+		t.Errorf("Expected round 1 to only be eliminated once")
+	}
+
+	// Round 2
+	db1.StoreTransaction(Transaction{UserID: "billy", Votes: Votes{"ted": 20}})
+	db1.StoreTransaction(Transaction{UserID: "jonny", Votes: Votes{"hil": 1}})
+	if e, err := db1.EliminateLowest(2); err != nil || e.Candidate != "hil" {
+		t.Errorf("Expected hil to be eliminated in round 2, got %s %v", e.Candidate, err)
+	}
+	if _, err := db1.EliminateLowest(3); err != ErrLastCandidate {
+		t.Errorf("Expected ErrLastCandidate, got %v", err)
+	}
+
+	results := db1.GetResults()
+	if results.Winner != "ted" {
+		t.Errorf("Expected ted to win, got %q", results.Winner)
+	}
+
+	expectedOrder := []Standing{
+		{Place: 1, Candidate: "ted", Votes: 25},
+		{Place: 2, Candidate: "hil", Votes: 10, EliminatedIn: 2},
+		{Place: 3, Candidate: "jeb", Votes: 2, EliminatedIn: 1},
+	}
+	if len(results.Standings) != len(expectedOrder) {
+		t.Fatalf("Expected %d standings, got %+v", len(expectedOrder), results.Standings)
+	}
+	for i, s := range expectedOrder {
+		if results.Standings[i] != s {
+			t.Errorf("Expected standing %+v, got %+v", s, results.Standings[i])
+		}
+	}
+
+	if len(results.Rounds) != 2 {
+		t.Fatalf("Expected 2 rounds, got %d", len(results.Rounds))
+	}
+	if results.Rounds[1].Votes["ted"] != 20 || results.Rounds[1].Votes["hil"] != 1 || results.Rounds[1].Votes["jeb"] != 0 {
+		t.Errorf("Unexpected round 2 votes: %v", results.Rounds[1].Votes)
+	}
+
+	if results.Transactions != 3 || results.Voters != 2 || results.TotalVotes != 37 {
+		t.Errorf("Expected 3 transactions from 2 voters with 37 votes, got %d %d %d",
+			results.Transactions, results.Voters, results.TotalVotes)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	db1, err := CreateOrOverwriteDB("TestExport.db")
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer db1.Close()
+
+	for _, can := range []string{"ted", "jeb", "hil"} {
+		if err := db1.AddCandidate(can); err != nil {
+			t.Errorf("Couldn't add %s: %v", can, err)
+		}
+	}
+	if err := db1.AddCandidate("ted"); err == nil {
+		t.Errorf("Expected adding ted twice to fail")
+	}
+	if err := db1.SetCandidateInfo("ted", CandidateInfo{Name: "Ted :)", Image: "battle/1.gif"}); err != nil {
+		t.Errorf("Couldn't set ted's info: %v", err)
+	}
+	if err := db1.SetCandidateInfo("bob", CandidateInfo{Name: "Bob"}); err == nil {
+		t.Errorf("Expected setting info for an unknown candidate to fail")
+	}
+
+	db1.StoreTransaction(Transaction{UserID: "jonny", Votes: Votes{"ted": 5, "jeb": 2}})
+	if err := db1.RemoveCandidate("ted"); err == nil {
+		t.Errorf("Expected removing a candidate with votes to fail")
+	}
+	if err := db1.RemoveCandidate("hil"); err != nil {
+		t.Errorf("Couldn't remove hil: %v", err)
+	}
+	db1.EliminateLowest(1)
+
+	var buf bytes.Buffer
+	if err := db1.Export(&buf); err != nil {
+		t.Fatalf("Couldn't export: %v", err)
+	}
+
+	db2, err := CreateOrOverwriteDB("TestImport.db")
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer db2.Close()
+
+	if err := db2.Import(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Couldn't import: %v", err)
+	}
+	if problems := db2.CheckConsistency(); len(problems) != 0 {
+		t.Errorf("Imported database is inconsistent: %v", problems)
+	}
+	if results := db2.GetResults(); results.Winner != "ted" || results.Transactions != 1 {
+		t.Errorf("Imported results don't match: %+v", results)
+	}
+	if err := db2.InitializeCandidates(candidatesNamed("bob", "jeb")); err == nil || len(db2.GetCandidates(true)) != 2 {
+		t.Errorf("Expected initializing an existing candidate to fail without adding any")
+	}
+	candidates := db2.GetCandidates(true)
+	if len(candidates) != 2 || candidates[0].DisplayName() != "jeb" || candidates[0].Active ||
+		candidates[1].DisplayName() != "Ted :)" || candidates[1].Image != "battle/1.gif" || !candidates[1].Active {
+		t.Errorf("Imported candidates don't match: %+v", candidates)
+	}
+
+	// New transactions carry on from the imported ones
+	if id, err := db2.SubmitTransaction(Transaction{UserID: "billy", Votes: Votes{"ted": 1}}); err != nil || id != 2 {
+		t.Errorf("Expected transaction 2 after import, got %d %v", id, err)
+	}
+
+	if err := db2.Import(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Errorf("Expected importing into a database with candidates to fail")
+	}
+}
+
+func TestWeightedTransactions(t *testing.T) {
+	db1, err := CreateOrOverwriteDB("TestWeightedTransactions.db")
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer db1.Close()
+
+	db1.InitializeCandidates(candidatesNamed("ted", "jeb"))
+
+	/* each row takes the form:
+	{weight, votes, stored}
+	*/
+	testData := []struct {
+		weight int
+		votes  Votes
+		stored bool
+	}{
+		{0, Votes{"ted": 1}, true},
+		{1, Votes{"jeb": 2}, true},
+		{3, Votes{"ted": 2, "jeb": 1}, true},
+		{-2, Votes{"ted": 1}, false},
+	}
+
+	for i, d := range testData {
+		_, err := db1.SubmitTransaction(Transaction{UserID: "jonny", Votes: d.votes, Weight: d.weight})
+		if stored := err == nil; stored != d.stored {
+			t.Errorf("Test[%d] expected stored to be %v, got %v", i, d.stored, err)
+		}
+	}
+
+	if votes := db1.GetVotes(); votes["ted"] != 1+6 || votes["jeb"] != 2+3 {
+		t.Errorf("Expected weighted totals, got %v", votes)
+	}
+	if problems := db1.CheckConsistency(); len(problems) != 0 {
+		t.Errorf("Weighted database is inconsistent: %v", problems)
+	}
+
+	var buf bytes.Buffer
+	db1.ExportAllTransactionsAsCSV(&buf)
+	for _, line := range []string{"Transaction Number,UserId,Weight,jeb,ted\n", "1,jonny,1,0,1\n", "3,jonny,3,3,6\n"} {
+		if !bytes.Contains(buf.Bytes(), []byte(line)) {
+			t.Errorf("Expected the CSV to contain %q, got %q", line, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := db1.Export(&buf); err != nil {
+		t.Fatalf("Couldn't export: %v", err)
+	}
+	db2, err := CreateOrOverwriteDB("TestWeightedImport.db")
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer db2.Close()
+	if err := db2.Import(&buf); err != nil {
+		t.Fatalf("Couldn't import: %v", err)
+	}
+	if tr := db2.GetAllTransactions()[3]; tr.Weight != 3 {
+		t.Errorf("Expected the weight to survive an export, got %+v", tr)
+	}
+	if problems := db2.CheckConsistency(); len(problems) != 0 {
+		t.Errorf("Imported database is inconsistent: %v", problems)
+	}
+}
+
+func TestVoteLimits(t *testing.T) {
+	/* each row takes the form:
+	{votes, rejected, candidate blamed}
+	*/
+	testData := []struct {
+		votes     Votes
+		rejected  bool
+		candidate string
+	}{
+		{Votes{"ted": 10, "jeb": 5}, false, ""},
+		{Votes{"ted": 11}, true, "ted"},
+		{Votes{"ted": -1}, true, "ted"},
+		{Votes{"ted": 0, "jeb": 1}, true, "ted"},
+		{Votes{"hil": 6, "jeb": 5, "ted": 5}, true, "ted"},
+		{Votes{}, true, ""},
+		{Votes{"ted": 1, "jeb": 1, "hil": 1, "bob": 1}, true, ""},
+	}
+
+	for i, d := range testData {
+		err := Transaction{UserID: "jonny", Votes: d.votes}.CheckLimits(10, 15, 3)
+		var ce *CandidateError
+		switch {
+		case !d.rejected && err != nil:
+			t.Errorf("Test[%d] expected no error, got %v", i, err)
+		case d.rejected && !errors.Is(err, ErrInvalidVoteCount):
+			t.Errorf("Test[%d] expected the transaction to be rejected, got %v", i, err)
+		case d.candidate != "" && (!errors.As(err, &ce) || ce.Candidate != d.candidate):
+			t.Errorf("Test[%d] expected %s to be over the limit, got %v", i, d.candidate, err)
+		}
+	}
+}
+
+func TestEmptyTransactions(t *testing.T) {
+	db1, err := CreateOrOverwriteDB(filepath.Join(t.TempDir(), "empty.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer db1.Close()
+	db1.InitializeCandidates(candidatesNamed("ted", "jeb"))
+
+	for i, votes := range []Votes{{}, {"ted": 0}, {"ted": 1, "jeb": 1, "hil": 1}} {
+		if err := db1.StoreTransaction(Transaction{UserID: "jonny", Votes: votes}); !errors.Is(err, ErrInvalidVoteCount) {
+			t.Errorf("Test[%d] expected %v to be rejected, got %v", i, votes, err)
+		}
+	}
+	if results := db1.GetResults(); results.Transactions != 0 || results.Voters != 0 {
+		t.Errorf("Expected nothing to be stored, got %d transactions from %d voters", results.Transactions, results.Voters)
+	}
+}
+
+func TestVoteOverflow(t *testing.T) {
+	db1, err := CreateOrOverwriteDB("TestVoteOverflow.db")
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer db1.Close()
+	db1.InitializeCandidates(candidatesNamed("ted"))
+
+	if err := db1.StoreTransaction(Transaction{UserID: "jonny", Votes: Votes{"ted": math.MaxInt / 2}}); err != nil {
+		t.Fatalf("Couldn't store a large transaction: %v", err)
+	}
+	err = db1.StoreTransaction(Transaction{UserID: "jonny", Votes: Votes{"ted": math.MaxInt / 4}, Weight: 3})
+	if !errors.Is(err, ErrInvalidVoteCount) {
+		t.Errorf("Expected a total which doesn't fit to be rejected, got %v", err)
+	}
+	if votes := db1.GetVotes(); votes["ted"] != math.MaxInt/2 {
+		t.Errorf("Expected the total not to wrap, got %d", votes["ted"])
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "old.db")
+
+	// A database from before CANDIDATE_INFO, REDEEMED_TOKENS and ELIMINATIONS were added
+	old, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	old.Update(func(tx *bolt.Tx) error {
+		for _, v := range expectedBuckets[:originalBuckets] {
+			tx.CreateBucket([]byte(v))
+		}
+		tx.Bucket([]byte("CANDIDATES")).Put([]byte("ted"), booltobyte(true))
+		tx.Bucket([]byte("VOTES")).Put([]byte("ted"), itob(7))
+		return nil
+	})
+	old.Close()
+
+	store, err := OpenDB(filename)
+	if err != nil {
+		t.Fatalf("Couldn't open the old database: %v", err)
+	}
+	defer store.Close()
+	if err := store.Verify(); err == nil {
+		t.Errorf("Expected the old database to be missing buckets")
+	}
+
+	created, err := store.Migrate()
+	if err != nil || len(created) != 3 {
+		t.Fatalf("Expected 3 buckets to be created, got %v %v", created, err)
+	}
+	if err := store.Verify(); err != nil {
+		t.Errorf("Expected the migrated database to pass: %v", err)
+	}
+	if votes := store.GetVotes(); votes["ted"] != 7 {
+		t.Errorf("Expected the votes to be kept, got %v", votes)
+	}
+	if created, err := store.Migrate(); err != nil || len(created) != 0 {
+		t.Errorf("Expected migrating again to do nothing, got %v %v", created, err)
+	}
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reasons a candidate can be rejected from a transaction.
+// Use errors.Is against a *CandidateError to find out which one occurred.
+var (
+	// ErrUnknownCandidate means the candidate is not in the CANDIDATES bucket
+	ErrUnknownCandidate = errors.New("unknown candidate")
+	// ErrCandidateEliminated means the candidate exists but can no longer receive votes
+	ErrCandidateEliminated = errors.New("candidate has been eliminated")
+	// ErrInvalidVoteCount means a negative number of votes was submitted, or more than allowed
+	ErrInvalidVoteCount = errors.New("vote count is negative or over the limit")
+)
+
+// CandidateError is returned when a transaction is rejected because of one of its candidates
+type CandidateError struct {
+	Candidate string
+	Reason    error
+	// RequestID is copied from the rejected transaction
+	RequestID string
+}
+
+func (e *CandidateError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("request %s: %s: %s", e.RequestID, e.Reason, e.Candidate)
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Candidate)
+}
+
+// Unwrap lets errors.Is match the Reason
+func (e *CandidateError) Unwrap() error {
+	return e.Reason
+}
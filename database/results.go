@@ -0,0 +1,197 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ErrLastCandidate is returned when trying to eliminate the only candidate left
+var ErrLastCandidate = errors.New("only one candidate is left")
+
+// Elimination records one round of the battle
+type Elimination struct {
+	Round     int
+	Candidate string
+	Time      time.Time
+	// Totals is a snapshot of every candidate's vote total when the round ended
+	Totals Votes
+}
+
+// Standing is one candidate's place in the final results
+type Standing struct {
+	Place     int
+	Candidate string
+	Votes     int
+	// EliminatedIn is the round the candidate was knocked out in, or 0 if they are still in
+	EliminatedIn int
+	// Disqualified candidates were eliminated by hand rather than in a round
+	Disqualified bool
+}
+
+// Round is the votes cast between one elimination and the next
+type Round struct {
+	Number     int
+	Eliminated string
+	Votes      Votes
+}
+
+// Results is everything shown on the results page
+type Results struct {
+	// Winner is empty until there is only one candidate left
+	Winner       string
+	Standings    []Standing
+	Rounds       []Round
+	Transactions int
+	Voters       int
+	TotalVotes   int
+}
+
+// EliminateLowest eliminates the active candidate with the fewest votes and records it as round.
+/* Ties go to the candidate whose name sorts first. The vote totals at the time
+are saved with the elimination so that per-round results can be worked out later.
+*/
+func (s *Store) EliminateLowest(round int) (Elimination, error) {
+	e := Elimination{Round: round, Time: time.Now(), Totals: make(Votes)}
+
+	err := s.update("EliminateLowest", func(tx *bolt.Tx) error {
+		bCAN := tx.Bucket([]byte("CANDIDATES"))
+		bVOT := tx.Bucket([]byte("VOTES"))
+		bELM := tx.Bucket([]byte("ELIMINATIONS"))
+
+		if bELM.Get(itob(round)) != nil {
+			return fmt.Errorf("round %d has already been eliminated", round)
+		}
+
+		lowest := -1
+		active := 0
+		c := bVOT.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			votes := btoi(v)
+			e.Totals[string(k)] = votes
+
+			if status := bCAN.Get(k); status == nil || !bytetobool(status) {
+				continue
+			}
+			active++
+			if lowest < 0 || votes < lowest {
+				lowest = votes
+				e.Candidate = string(k)
+			}
+		}
+
+		if active <= 1 {
+			return ErrLastCandidate
+		}
+
+		bCAN.Put([]byte(e.Candidate), booltobyte(false))
+
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return bELM.Put(itob(round), buf)
+	})
+	if err != nil {
+		return Elimination{}, err
+	}
+	return e, nil
+}
+
+// GetEliminations returns every recorded elimination in round order
+func (s *Store) GetEliminations() []Elimination {
+	var eliminations []Elimination
+
+	s.view("GetEliminations", func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("ELIMINATIONS")).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var e Elimination
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("Unable to unmarshal elimination %d", btoi(k))
+			}
+			eliminations = append(eliminations, e)
+		}
+		return nil
+	})
+	return eliminations
+}
+
+// GetResults works out the finishing order and per-round votes from the elimination history
+func (s *Store) GetResults() Results {
+	var results Results
+
+	totals := s.GetVotes()
+	eliminations := s.GetEliminations()
+	active := s.GetCandidateList(false)
+
+	if len(active) == 1 {
+		results.Winner = active[0]
+	}
+
+	// Candidates still in the running take the top places, ordered by votes
+	sortByVotes(active, totals)
+	for _, can := range active {
+		results.Standings = append(results.Standings, Standing{Candidate: can, Votes: totals[can]})
+	}
+	// Then everyone else, last eliminated first
+	inRound := make(map[string]bool)
+	for i := len(eliminations) - 1; i >= 0; i-- {
+		e := eliminations[i]
+		inRound[e.Candidate] = true
+		results.Standings = append(results.Standings, Standing{
+			Candidate:    e.Candidate,
+			Votes:        totals[e.Candidate],
+			EliminatedIn: e.Round,
+		})
+	}
+	// Disqualified candidates come last
+	stillIn := make(map[string]bool)
+	for _, can := range active {
+		stillIn[can] = true
+	}
+	for _, can := range s.GetCandidateList(true) {
+		if !stillIn[can] && !inRound[can] {
+			results.Standings = append(results.Standings, Standing{Candidate: can, Votes: totals[can], Disqualified: true})
+		}
+	}
+	for i := range results.Standings {
+		results.Standings[i].Place = i + 1
+	}
+
+	// Each round's votes are the difference between its snapshot and the one before
+	previous := make(Votes)
+	for _, e := range eliminations {
+		round := Round{Number: e.Round, Eliminated: e.Candidate, Votes: make(Votes)}
+		for can, total := range e.Totals {
+			round.Votes[can] = total - previous[can]
+		}
+		results.Rounds = append(results.Rounds, round)
+		previous = e.Totals
+	}
+
+	voters := make(map[string]bool)
+	for _, t := range s.GetAllTransactions() {
+		results.Transactions++
+		voters[t.UserID] = true
+	}
+	results.Voters = len(voters)
+	for _, total := range totals {
+		results.TotalVotes += total
+	}
+
+	return results
+}
+
+// sortByVotes sorts candidates by most votes first, then by name
+func sortByVotes(candidates []string, totals Votes) {
+	sort.Slice(candidates, func(i, j int) bool {
+		if totals[candidates[i]] != totals[candidates[j]] {
+			return totals[candidates[i]] > totals[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+}
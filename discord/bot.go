@@ -0,0 +1,153 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxStandings is how many candidates are listed after an elimination, to stay well inside Discord's message limit
+const maxStandings = 10
+
+// Bot announces the progress of the battle in a Discord channel
+type Bot struct {
+	client    Client
+	channelID string
+	voteURL   string
+}
+
+// NewBot creates a bot which posts to Discord.AnnounceChannel
+func NewBot(client Client, conf config.Config) *Bot {
+	return &Bot{client: client, channelID: conf.Discord.AnnounceChannel, voteURL: conf.Discord.VoteURL}
+}
+
+// AnnounceStart posts that the battle has started, and when it ends
+func (b *Bot) AnnounceStart(ctx context.Context, electionName string, candidates []database.Candidate, end time.Time) error {
+	active := 0
+	for _, can := range candidates {
+		if can.Active {
+			active++
+		}
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "**%s** has started! %d candidates are in the battle, and one is eliminated every round until <t:%d:f>.",
+		electionName, active, end.Unix())
+	b.writeVoteLink(&msg)
+	return b.send(ctx, msg.String())
+}
+
+// AnnounceElimination posts who was knocked out in round e, and the standings of those still in.
+// results should be from straight after the elimination.
+func (b *Bot) AnnounceElimination(ctx context.Context, e database.Elimination, results database.Results, candidates []database.Candidate) error {
+	byID := candidatesByID(candidates)
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "Round %d is over: %s has been eliminated with %s.\n\n**Still in the battle**\n",
+		e.Round, Render(byID.get(e.Candidate)), plural(e.Totals[e.Candidate], "vote"))
+
+	active := activeStandings(results)
+	for i, st := range active {
+		if i == maxStandings {
+			fmt.Fprintf(&msg, "…and %d more\n", len(active)-i)
+			break
+		}
+		fmt.Fprintf(&msg, "%d. %s, %s\n", st.Place, Render(byID.get(st.Candidate)), plural(st.Votes, "vote"))
+	}
+	b.writeVoteLink(&msg)
+	return b.send(ctx, msg.String())
+}
+
+// AnnounceWinner posts the winner of the battle
+func (b *Bot) AnnounceWinner(ctx context.Context, electionName string, results database.Results, candidates []database.Candidate) error {
+	if results.Winner == "" {
+		return fmt.Errorf("there is no winner yet")
+	}
+	byID := candidatesByID(candidates)
+
+	votes := 0
+	for _, s := range results.Standings {
+		if s.Candidate == results.Winner {
+			votes = s.Votes
+		}
+	}
+
+	msg := fmt.Sprintf("👑 %s has won **%s** with %s! %s cast %s in total.",
+		Render(byID.get(results.Winner)), electionName, plural(votes, "vote"), plural(results.Voters, "voter"), plural(results.TotalVotes, "vote"))
+	return b.send(ctx, msg)
+}
+
+func (b *Bot) send(ctx context.Context, content string) error {
+	if _, err := b.client.ChannelMessageSend(b.channelID, content, discordgo.WithContext(ctx)); err != nil {
+		return fmt.Errorf("Unable to post to channel %s: %v", b.channelID, err)
+	}
+	return nil
+}
+
+func (b *Bot) writeVoteLink(msg *strings.Builder) {
+	if b.voteURL != "" {
+		fmt.Fprintf(msg, "\nVote at %s", b.voteURL)
+	}
+}
+
+// snowflake matches Discord IDs, which imported emoji use as their candidate ID
+var snowflake = regexp.MustCompile(`^[0-9]{17,20}$`)
+
+// Render shows a candidate in a Discord message. Candidates imported from Discord are shown as the emoji itself.
+func Render(can database.Candidate) string {
+	if !isEmoji(can) {
+		return "**" + can.DisplayName() + "**"
+	}
+	prefix := "<:"
+	for _, tag := range can.Tags {
+		if tag == AnimatedTag {
+			prefix = "<a:"
+		}
+	}
+	return prefix + can.Name + ":" + can.ID + ">"
+}
+
+// candidateMap looks up candidates by ID
+type candidateMap map[string]database.Candidate
+
+func candidatesByID(candidates []database.Candidate) candidateMap {
+	byID := make(candidateMap)
+	for _, can := range candidates {
+		byID[can.ID] = can
+	}
+	return byID
+}
+
+// get returns the candidate with id, or one with just the ID if it isn't known
+func (m candidateMap) get(id string) database.Candidate {
+	if can, ok := m[id]; ok {
+		return can
+	}
+	return database.Candidate{ID: id}
+}
+
+// activeStandings are the candidates still in the battle, most votes first
+func activeStandings(results database.Results) []database.Standing {
+	var active []database.Standing
+	for _, s := range results.Standings {
+		if s.EliminatedIn == 0 && !s.Disqualified {
+			active = append(active, s)
+		}
+	}
+	return active
+}
+
+// plural writes n followed by noun, adding an s unless there is exactly one
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
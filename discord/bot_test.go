@@ -0,0 +1,106 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+)
+
+func TestRender(t *testing.T) {
+	/* each row takes the form:
+	{candidate, expected}
+	*/
+	testData := []struct {
+		can      database.Candidate
+		expected string
+	}{
+		{database.Candidate{ID: "672547554004828180", CandidateInfo: database.CandidateInfo{Name: "thonk"}}, "<:thonk:672547554004828180>"},
+		{database.Candidate{ID: "672547554004828180", CandidateInfo: database.CandidateInfo{Name: "parrot", Tags: []string{AnimatedTag}}}, "<a:parrot:672547554004828180>"},
+		{database.Candidate{ID: "672547554004828180"}, "**672547554004828180**"},
+		{database.Candidate{ID: "jeb", CandidateInfo: database.CandidateInfo{Name: "Jeb"}}, "**Jeb**"},
+	}
+
+	for i, d := range testData {
+		if got := Render(d.can); got != d.expected {
+			t.Errorf("Test[%d] expected %q, got %q", i, d.expected, got)
+		}
+	}
+}
+
+func TestAnnouncements(t *testing.T) {
+	guild := newTestGuild(t)
+	bot := NewBot(guild, config.Config{Discord: config.DiscordConfig{AnnounceChannel: "channel", VoteURL: "https://example.com/vote"}})
+	ctx := context.Background()
+
+	var candidates []database.Candidate
+	results := database.Results{}
+	for i := 0; i < 13; i++ {
+		id := fmt.Sprintf("%018d", i)
+		candidates = append(candidates, database.Candidate{ID: id, CandidateInfo: database.CandidateInfo{Name: fmt.Sprintf("emoji%d", i)}, Active: i > 0})
+		st := database.Standing{Place: i + 1, Candidate: id, Votes: 13 - i}
+		if i == 12 {
+			st.EliminatedIn = 1
+		}
+		results.Standings = append(results.Standings, st)
+	}
+	end := time.Date(2030, 7, 6, 5, 45, 0, 0, time.UTC)
+
+	if err := bot.AnnounceStart(ctx, "Emoji Battle", candidates, end); err != nil {
+		t.Fatalf("AnnounceStart failed: %v", err)
+	}
+	e := database.Elimination{Round: 1, Candidate: candidates[12].ID, Totals: database.Votes{candidates[12].ID: 1}}
+	if err := bot.AnnounceElimination(ctx, e, results, candidates); err != nil {
+		t.Fatalf("AnnounceElimination failed: %v", err)
+	}
+	if err := bot.AnnounceWinner(ctx, "Emoji Battle", results, candidates); err == nil {
+		t.Errorf("Expected no winner to be announced while there are candidates left")
+	}
+	results.Winner = candidates[0].ID
+	results.Voters, results.TotalVotes = 4, 91
+	if err := bot.AnnounceWinner(ctx, "Emoji Battle", results, candidates); err != nil {
+		t.Fatalf("AnnounceWinner failed: %v", err)
+	}
+
+	/* each row takes the form:
+	{message, text it should contain}
+	*/
+	testData := []struct {
+		message int
+		text    string
+	}{
+		{0, "**Emoji Battle** has started! 12 candidates"},
+		{0, fmt.Sprintf("<t:%d:f>", end.Unix())},
+		{0, "Vote at https://example.com/vote"},
+		{1, "Round 1 is over: <:emoji12:000000000000000012> has been eliminated with 1 vote."},
+		{1, "1. <:emoji0:000000000000000000>, 13 votes\n"},
+		{1, "10. <:emoji9:000000000000000009>, 4 votes\n…and 2 more\n"},
+		{2, "👑 <:emoji0:000000000000000000> has won **Emoji Battle** with 13 votes! 4 voters cast 91 votes in total."},
+	}
+
+	var sent []string
+	for _, msg := range guild.Messages("channel") {
+		sent = append(sent, msg.Content)
+	}
+	if len(sent) != 3 {
+		t.Fatalf("Expected 3 messages, got %d: %q", len(sent), sent)
+	}
+	for i, d := range testData {
+		if !strings.Contains(sent[d.message], d.text) {
+			t.Errorf("Test[%d] expected message %d to contain %q, got %q", i, d.message, d.text, sent[d.message])
+		}
+	}
+	if strings.Contains(sent[1], "emoji10") {
+		t.Errorf("Expected the standings to stop after %d candidates: %q", maxStandings, sent[1])
+	}
+
+	guild.Fail("ChannelMessageSend", errors.New("missing access"))
+	if err := bot.AnnounceStart(ctx, "Emoji Battle", candidates, end); err == nil {
+		t.Errorf("Expected a failed post to be an error")
+	}
+}
@@ -0,0 +1,65 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"Emoji-battle-royale/config"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Client is every guild, emoji, message, direct message and CDN operation the project uses.
+// Session talks to the real Discord, and discordtest.Guild is an in-process fake.
+type Client interface {
+	GuildEmojis(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Emoji, error)
+	GuildEmojiEdit(guildID, emojiID string, data *discordgo.EmojiParams, options ...discordgo.RequestOption) (*discordgo.Emoji, error)
+	GuildEmojiDelete(guildID, emojiID string, options ...discordgo.RequestOption) error
+	GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error)
+	GuildMemberRoleAdd(guildID, userID, roleID string, options ...discordgo.RequestOption) error
+
+	UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessagePin(channelID, messageID string, options ...discordgo.RequestOption) error
+	MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error
+	MessageReactionRemove(channelID, messageID, emojiID, userID string, options ...discordgo.RequestOption) error
+
+	ApplicationCommandCreate(appID string, guildID string, cmd *discordgo.ApplicationCommand, options ...discordgo.RequestOption) (*discordgo.ApplicationCommand, error)
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+
+	// EmojiImage starts downloading an emoji image from the CDN. file is the emoji ID with .png or .gif.
+	EmojiImage(ctx context.Context, file string) (*http.Response, error)
+}
+
+// Session is the real Discord: the API through discordgo, and the CDN over HTTP
+type Session struct {
+	*discordgo.Session
+	cdnURL string
+	http   *http.Client
+}
+
+// NewSession creates a session which logs in with the bot token in DiscordKey.
+// It doesn't connect to Discord until it is used.
+func NewSession(conf config.Config) (*Session, error) {
+	if conf.DiscordKey == "" {
+		return nil, fmt.Errorf("DiscordKey must be set to use the Discord bot")
+	}
+
+	session, err := discordgo.New("Bot " + conf.DiscordKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Session: session, cdnURL: conf.Discord.CDNURL, http: &http.Client{}}, nil
+}
+
+// EmojiImage starts downloading an emoji image from Discord.CDNURL
+func (s *Session) EmojiImage(ctx context.Context, file string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(s.cdnURL, "/")+"/emojis/"+file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.http.Do(req)
+}
@@ -0,0 +1,186 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxEmojiName is the longest name Discord allows for an emoji
+const maxEmojiName = 32
+
+// Action is one change made on Discord when the winner is crowned
+type Action struct {
+	// Description says what the action does, for dry runs and logs
+	Description string
+	run         func(ctx context.Context) error
+}
+
+// Run carries out the action
+func (a Action) Run(ctx context.Context) error {
+	return a.run(ctx)
+}
+
+// Crowner works out and carries out the actions set in the Discord section of the config
+// once the battle has a winner
+type Crowner struct {
+	client         Client
+	guildID        string
+	channelID      string
+	championPrefix string
+	losers         string
+	archivePrefix  string
+	championRole   string
+	topVoters      int
+	pinResults     bool
+}
+
+// NewCrowner creates a Crowner for the server in GuildID, doing what is turned on in the Discord section
+func NewCrowner(client Client, conf config.Config) *Crowner {
+	return &Crowner{
+		client:         client,
+		guildID:        conf.GuildID,
+		channelID:      conf.Discord.AnnounceChannel,
+		championPrefix: conf.Discord.ChampionPrefix,
+		losers:         conf.Discord.Losers,
+		archivePrefix:  conf.Discord.ArchivePrefix,
+		championRole:   conf.Discord.ChampionRole,
+		topVoters:      conf.Discord.TopVoters,
+		pinResults:     conf.Discord.PinResults,
+	}
+}
+
+// Plan lists the actions for crowning the winner in results, in the order they should be run.
+// Only candidates imported from Discord are renamed or removed, and only Discord users can be given the role.
+func (c *Crowner) Plan(electionName string, results database.Results, candidates []database.Candidate, transactions map[int]database.Transaction) []Action {
+	var actions []Action
+	byID := candidatesByID(candidates)
+
+	winner := byID.get(results.Winner)
+	if c.championPrefix != "" && isEmoji(winner) && !strings.HasPrefix(winner.Name, c.championPrefix) {
+		actions = append(actions, c.rename(winner, c.championPrefix))
+	}
+
+	for _, can := range candidates {
+		if can.ID == results.Winner || !isEmoji(can) {
+			continue
+		}
+		switch c.losers {
+		case "archive":
+			if !strings.HasPrefix(can.Name, c.archivePrefix) {
+				actions = append(actions, c.rename(can, c.archivePrefix))
+			}
+		case "remove":
+			id := can.ID
+			actions = append(actions, Action{
+				Description: fmt.Sprintf("Remove the emoji :%s: (%s)", can.Name, can.ID),
+				run: func(ctx context.Context) error {
+					return c.client.GuildEmojiDelete(c.guildID, id, discordgo.WithContext(ctx))
+				},
+			})
+		}
+	}
+
+	if c.championRole != "" {
+		for _, voter := range topVoters(transactions, c.topVoters) {
+			userID := voter.UserID
+			actions = append(actions, Action{
+				Description: fmt.Sprintf("Give role %s to user %s, whose votes counted %s", c.championRole, userID, plural(voter.Votes, "vote")),
+				run: func(ctx context.Context) error {
+					return c.client.GuildMemberRoleAdd(c.guildID, userID, c.championRole, discordgo.WithContext(ctx))
+				},
+			})
+		}
+	}
+
+	if c.pinResults {
+		content := finalResults(electionName, results, byID)
+		actions = append(actions, Action{
+			Description: fmt.Sprintf("Post the final results to channel %s and pin them", c.channelID),
+			run: func(ctx context.Context) error {
+				msg, err := c.client.ChannelMessageSend(c.channelID, content, discordgo.WithContext(ctx))
+				if err != nil {
+					return err
+				}
+				return c.client.ChannelMessagePin(c.channelID, msg.ID, discordgo.WithContext(ctx))
+			},
+		})
+	}
+
+	return actions
+}
+
+// rename gives an emoji a prefix, keeping within Discord's limit on the length of names
+func (c *Crowner) rename(can database.Candidate, prefix string) Action {
+	name := prefix + can.Name
+	if len(name) > maxEmojiName {
+		name = name[:maxEmojiName]
+	}
+	id := can.ID
+	return Action{
+		Description: fmt.Sprintf("Rename the emoji :%s: (%s) to :%s:", can.Name, can.ID, name),
+		run: func(ctx context.Context) error {
+			_, err := c.client.GuildEmojiEdit(c.guildID, id, &discordgo.EmojiParams{Name: name}, discordgo.WithContext(ctx))
+			return err
+		},
+	}
+}
+
+// voterTotal is how much one voter's votes counted for over the whole battle, with their weights
+type voterTotal struct {
+	UserID string
+	Votes  int
+}
+
+// topVoters finds the n Discord users whose votes counted the most, so a member whose roles
+// weight their votes counts their weighted total. Ties go to the lowest user ID.
+func topVoters(transactions map[int]database.Transaction, n int) []voterTotal {
+	totals := make(map[string]int)
+	for _, t := range transactions {
+		// Voters who logged in with a token rather than Discord can't be given a role
+		if !snowflake.MatchString(t.UserID) {
+			continue
+		}
+		for _, votes := range t.Votes {
+			totals[t.UserID] += votes * t.Multiplier()
+		}
+	}
+
+	var voters []voterTotal
+	for userID, votes := range totals {
+		if votes > 0 {
+			voters = append(voters, voterTotal{UserID: userID, Votes: votes})
+		}
+	}
+	sort.Slice(voters, func(i, j int) bool {
+		if voters[i].Votes != voters[j].Votes {
+			return voters[i].Votes > voters[j].Votes
+		}
+		return voters[i].UserID < voters[j].UserID
+	})
+	if len(voters) > n {
+		voters = voters[:n]
+	}
+	return voters
+}
+
+// finalResults is the message listing where everyone finished
+func finalResults(electionName string, results database.Results, byID candidateMap) string {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "🏆 **Final results of %s**\n", electionName)
+	for i, s := range results.Standings {
+		if i == maxStandings {
+			fmt.Fprintf(&msg, "…and %d more\n", len(results.Standings)-i)
+			break
+		}
+		fmt.Fprintf(&msg, "%d. %s, %s\n", s.Place, Render(byID.get(s.Candidate)), plural(s.Votes, "vote"))
+	}
+	fmt.Fprintf(&msg, "%s cast %s in total.", plural(results.Voters, "voter"), plural(results.TotalVotes, "vote"))
+	return msg.String()
+}
@@ -0,0 +1,165 @@
+package discord
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+)
+
+func crownConfig(losers string) config.Config {
+	return config.Config{
+		GuildID: testGuild,
+		Discord: config.DiscordConfig{
+			AnnounceChannel: "channel",
+			ChampionPrefix:  "champion_",
+			Losers:          losers,
+			ArchivePrefix:   "archived_",
+			ChampionRole:    "role",
+			TopVoters:       2,
+			PinResults:      true,
+		},
+	}
+}
+
+func TestCrown(t *testing.T) {
+	/* each row takes the form:
+	{Losers, winner's name after, loser's name after or "" if removed}
+	*/
+	testData := []struct {
+		losers string
+		winner string
+		loser  string
+	}{
+		{"keep", "champion_thonk", "partyparrot"},
+		{"archive", "champion_thonk", "archived_partyparrot"},
+		{"remove", "champion_thonk", ""},
+	}
+
+	for i, d := range testData {
+		guild := newTestGuild(t)
+		thonk := guild.AddEmoji("thonk", false)
+		parrot := guild.AddEmoji("partyparrot", false)
+
+		candidates := []database.Candidate{
+			{ID: thonk.ID, CandidateInfo: database.CandidateInfo{Name: "thonk"}, Active: true},
+			{ID: parrot.ID, CandidateInfo: database.CandidateInfo{Name: "partyparrot"}},
+			{ID: "jeb", CandidateInfo: database.CandidateInfo{Name: "Jeb"}},
+		}
+		results := database.Results{
+			Winner: thonk.ID,
+			Standings: []database.Standing{
+				{Place: 1, Candidate: thonk.ID, Votes: 9},
+				{Place: 2, Candidate: parrot.ID, Votes: 4, EliminatedIn: 2},
+				{Place: 3, Candidate: "jeb", Votes: 1, EliminatedIn: 1},
+			},
+			Voters:     4,
+			TotalVotes: 14,
+		}
+		transactions := map[int]database.Transaction{
+			1: {UserID: "80351110224678912", Votes: database.Votes{thonk.ID: 5}},
+			2: {UserID: "80351110224678913", Votes: database.Votes{parrot.ID: 4}},
+			3: {UserID: "80351110224678914", Votes: database.Votes{thonk.ID: 4}},
+			// Token voters can't be given a role, however much they vote
+			4: {UserID: "token-voter", Votes: database.Votes{"jeb": 10}},
+		}
+
+		actions := NewCrowner(guild, crownConfig(d.losers)).Plan("Emoji Battle", results, candidates, transactions)
+
+		// Planning alone changes nothing, which is what a dry run relies on
+		if guild.Emoji(thonk.ID).Name != "thonk" || len(guild.Messages("channel")) != 0 {
+			t.Errorf("Test[%d] expected no changes before running", i)
+		}
+		for _, a := range actions {
+			if err := a.Run(context.Background()); err != nil {
+				t.Errorf("Test[%d] %s failed: %v", i, a.Description, err)
+			}
+		}
+
+		if name := guild.Emoji(thonk.ID).Name; name != d.winner {
+			t.Errorf("Test[%d] expected the winner to be :%s:, got :%s:", i, d.winner, name)
+		}
+		loser := guild.Emoji(parrot.ID)
+		switch {
+		case d.loser == "" && loser != nil:
+			t.Errorf("Test[%d] expected the loser to be removed, got :%s:", i, loser.Name)
+		case d.loser != "" && (loser == nil || loser.Name != d.loser):
+			t.Errorf("Test[%d] expected the loser to be :%s:, got %+v", i, d.loser, loser)
+		}
+		for _, user := range []string{"80351110224678912", "80351110224678913"} {
+			if roles := guild.Roles(user); len(roles) != 1 || roles[0] != "role" {
+				t.Errorf("Test[%d] expected %s to be given the role, got %v", i, user, roles)
+			}
+		}
+		if roles := guild.Roles("80351110224678914"); len(roles) != 0 {
+			t.Errorf("Test[%d] expected only the top 2 voters to be given the role, got %v", i, roles)
+		}
+
+		msgs := guild.Messages("channel")
+		if len(msgs) != 1 {
+			t.Fatalf("Test[%d] expected the results to be posted once, got %d messages", i, len(msgs))
+		}
+		if pinned := guild.Pinned("channel"); len(pinned) != 1 || pinned[0] != msgs[0].ID {
+			t.Errorf("Test[%d] expected the results to be pinned, got %v", i, pinned)
+		}
+		for _, text := range []string{"Final results of Emoji Battle", "1. <:thonk:" + thonk.ID + ">, 9 votes", "3. **Jeb**, 1 vote", "4 voters cast 14 votes"} {
+			if !strings.Contains(msgs[0].Content, text) {
+				t.Errorf("Test[%d] expected the results to contain %q, got %q", i, text, msgs[0].Content)
+			}
+		}
+	}
+}
+
+func TestTopVoters(t *testing.T) {
+	transactions := map[int]database.Transaction{
+		1: {UserID: "80351110224678912", Votes: database.Votes{"thonk": 5}},
+		// Fewer clicks, but a booster's votes count three times
+		2: {UserID: "80351110224678913", Votes: database.Votes{"thonk": 1, "jeb": 1}, Weight: 3},
+		3: {UserID: "80351110224678914", Votes: database.Votes{"thonk": 4}, Weight: 1},
+		4: {UserID: "80351110224678914", Votes: database.Votes{"jeb": 2}},
+		5: {UserID: "token-voter", Votes: database.Votes{"jeb": 10}, Weight: 2},
+	}
+
+	/* each row takes the form:
+	{n, expected voters in order, expected totals}
+	*/
+	testData := []struct {
+		n      int
+		voters []string
+		totals []int
+	}{
+		{1, []string{"80351110224678913"}, []int{6}},
+		{2, []string{"80351110224678913", "80351110224678914"}, []int{6, 6}},
+		{5, []string{"80351110224678913", "80351110224678914", "80351110224678912"}, []int{6, 6, 5}},
+	}
+
+	for i, d := range testData {
+		got := topVoters(transactions, d.n)
+		if len(got) != len(d.voters) {
+			t.Errorf("Test[%d] expected %d voters, got %+v", i, len(d.voters), got)
+			continue
+		}
+		for j, v := range got {
+			if v.UserID != d.voters[j] || v.Votes != d.totals[j] {
+				t.Errorf("Test[%d] expected %s with %d votes in place %d, got %+v", i, d.voters[j], d.totals[j], j+1, v)
+			}
+		}
+	}
+}
+
+func TestCrownAlreadyCrowned(t *testing.T) {
+	candidates := []database.Candidate{
+		{ID: "672547554004828180", CandidateInfo: database.CandidateInfo{Name: "champion_thonk"}, Active: true},
+		{ID: "672547554004828181", CandidateInfo: database.CandidateInfo{Name: "archived_partyparrot"}},
+	}
+	results := database.Results{Winner: "672547554004828180"}
+
+	conf := crownConfig("archive")
+	conf.Discord.ChampionRole = ""
+	conf.Discord.PinResults = false
+	if actions := NewCrowner(newTestGuild(t), conf).Plan("Emoji Battle", results, candidates, nil); len(actions) != 0 {
+		t.Errorf("Expected nothing left to do, got %d actions", len(actions))
+	}
+}
@@ -1,76 +1,99 @@
-package main
+// Package discord imports the custom emoji of a Discord server as candidates
+package discord
 
 import (
+	"context"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-func main() {
+// AnimatedTag is the tag given to candidates imported from animated emoji
+const AnimatedTag = "animated"
 
-	battleid := "gogogogo"
-	guildid := "152893724500819969"
-	botkey := "NjcyNTQ3NTU0MDA0ODI4MTgw.Xj20TA.-PawAcfzEC8Mae-dNbl7WyLD1XM"
+// Importer downloads every custom emoji of the server in GuildID and adds them as candidates
+type Importer struct {
+	client   Client
+	guildID  string
+	imageDir string
+	emojiDir string
 
-	discord, derr := discordgo.New("Bot " + botkey)
-	if derr != nil {
-		log.Fatal(derr)
-	}
+	downloads int
+	timeout   time.Duration
+	retries   int
+	backoff   time.Duration
+	maxSize   int
+}
 
-	guild, gerr := discord.Guild(guildid)
-	if gerr != nil {
-		log.Fatal(gerr)
+// NewImporter creates an importer for the server in GuildID, using the settings in the Discord section
+func NewImporter(client Client, conf config.Config) (*Importer, error) {
+	if conf.GuildID == "" {
+		return nil, fmt.Errorf("GuildID must be set to import emoji")
 	}
 
-	path := "../public/" + battleid + "/"
+	return &Importer{
+		client:    client,
+		guildID:   conf.GuildID,
+		imageDir:  conf.ImageDir,
+		emojiDir:  conf.Discord.EmojiDir,
+		downloads: conf.Discord.Downloads,
+		timeout:   conf.Discord.DownloadTimeout,
+		retries:   conf.Discord.DownloadRetries,
+		backoff:   time.Second,
+		maxSize:   conf.Discord.MaxEmojiSize,
+	}, nil
+}
 
-	if _, err := os.Stat("../public"); os.IsNotExist(err) {
-		os.Mkdir(path, 0755)
-	}
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		os.Mkdir(path, 0755)
+// Download saves every emoji into EmojiDir and returns those saved as candidates, without touching the database.
+// Candidates are identified by the emoji ID and named after the emoji, animated ones are tagged AnimatedTag.
+// Emoji which fail to download are listed in the report, the error is only for when nothing could be tried.
+func (im *Importer) Download(ctx context.Context) ([]database.Candidate, Report, error) {
+	emojis, err := im.client.GuildEmojis(im.guildID, discordgo.WithContext(ctx))
+	if err != nil {
+		return nil, Report{}, fmt.Errorf("Unable to list the emoji of guild %s: %v", im.guildID, err)
 	}
-	moderr := os.Chmod(path, 0755)
-	if moderr != nil {
-		fmt.Println(moderr)
+
+	dir := filepath.Join(im.imageDir, im.emojiDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, Report{}, err
 	}
 
-	for _, emoji := range guild.Emojis {
-		file := emoji.ID + ".png"
-		if emoji.Animated {
-			file = emoji.ID + ".gif"
-		}
-		url := discordgo.EndpointCDN + "emojis/" + file
-		filepath := path + file
+	report, ok := im.downloadAll(ctx, dir, emojis)
 
-		err := DownloadFile(filepath, url)
-		if err != nil {
-			log.Fatal(err)
+	var candidates []database.Candidate
+	for i, emoji := range emojis {
+		if !ok[i] {
+			continue
+		}
+		// Image paths always use slashes, they are served as URLs
+		info := database.CandidateInfo{Name: emoji.Name, Image: path.Join(filepath.ToSlash(im.emojiDir), emojiFile(emoji))}
+		if emoji.Animated {
+			info.Tags = []string{AnimatedTag}
 		}
+		candidates = append(candidates, database.Candidate{ID: emoji.ID, CandidateInfo: info, Active: true})
 	}
+	return candidates, report, nil
 }
 
-// DownloadFile saves each emoji to the project folder
-func DownloadFile(filepath string, url string) error {
-
-	// Create the data
-	resp, err := http.Get(url)
+// Import downloads every emoji and adds them to the store as candidates.
+// Nothing is added if any emoji fails to download, in which case the error is a *DownloadError.
+// Running it again only saves the emoji which changed, adds the new ones
+// and updates the names and images of those which are already candidates.
+func (im *Importer) Import(ctx context.Context, store *database.Store) (Report, error) {
+	candidates, report, err := im.Download(ctx)
 	if err != nil {
-		return err
+		return report, err
 	}
-	defer resp.Body.Close()
-
-	// Create the file
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
+	if err := report.Err(); err != nil {
+		return report, err
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
+	report.Added, err = store.UpsertCandidates(candidates)
+	return report, err
 }
@@ -0,0 +1,212 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+	"Emoji-battle-royale/discord/discordtest"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The fake has to keep up with everything the real Discord is used for
+var _ Client = (*discordtest.Guild)(nil)
+
+const testGuild = "152893724500819969"
+
+// newTestGuild creates a fake guild which is closed at the end of the test
+func newTestGuild(t *testing.T) *discordtest.Guild {
+	guild := discordtest.New(testGuild)
+	t.Cleanup(guild.Close)
+	return guild
+}
+
+// newTestImporter creates an importer for guild which saves into a temporary directory
+func newTestImporter(t *testing.T, guild *discordtest.Guild) *Importer {
+	im, err := NewImporter(guild, config.Config{
+		GuildID:  testGuild,
+		ImageDir: t.TempDir(),
+		Discord: config.DiscordConfig{
+			EmojiDir:        "battle",
+			Downloads:       2,
+			DownloadTimeout: time.Second,
+			DownloadRetries: 2,
+			MaxEmojiSize:    1024,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create importer: %v", err)
+	}
+	im.backoff = time.Millisecond
+	return im
+}
+
+func newTestStore(t *testing.T) *database.Store {
+	store, err := database.CreateOrOverwriteDB(filepath.Join(t.TempDir(), "import.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestImport(t *testing.T) {
+	guild := newTestGuild(t)
+	parrot := guild.AddEmoji("partyparrot", true)
+	thonk := guild.AddEmoji("thonk", false)
+	flaky := guild.AddEmoji("flaky", false)
+	guild.FailImage(flaky.ID+".png", http.StatusBadGateway, 2)
+
+	im := newTestImporter(t, guild)
+	store := newTestStore(t)
+
+	report, err := im.Import(context.Background(), store)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if n := guild.ImageRequests(flaky.ID + ".png"); report.Downloaded != 3 || report.Unchanged != 0 || n != 3 {
+		t.Errorf("Unexpected report %+v after %d tries of the flaky emoji", report, n)
+	}
+
+	/* each row takes the form:
+	{ID, name, image, data, tag count}
+	*/
+	testData := []struct {
+		id, name, image string
+		data            []byte
+		tags            int
+	}{
+		{parrot.ID, "partyparrot", "battle/" + parrot.ID + ".gif", discordtest.GIF, 1},
+		{thonk.ID, "thonk", "battle/" + thonk.ID + ".png", discordtest.PNG, 0},
+		{flaky.ID, "flaky", "battle/" + flaky.ID + ".png", discordtest.PNG, 0},
+	}
+
+	candidates := store.GetCandidates(true)
+	if len(candidates) != len(testData) {
+		t.Fatalf("Expected %d candidates, got %d", len(testData), len(candidates))
+	}
+	for i, d := range testData {
+		c := candidates[i]
+		if c.ID != d.id || c.Name != d.name || c.Image != d.image || len(c.Tags) != d.tags {
+			t.Errorf("Test[%d] expected %s %s %s, got %+v", i, d.id, d.name, d.image, c)
+		}
+		data, err := os.ReadFile(filepath.Join(im.imageDir, filepath.FromSlash(d.image)))
+		if err != nil || string(data) != string(d.data) {
+			t.Errorf("Test[%d] image not saved: %q %v", i, data, err)
+		}
+	}
+
+	// Only the images should be left behind, no temporary files
+	files, _ := os.ReadDir(filepath.Join(im.imageDir, "battle"))
+	if len(files) != len(testData) {
+		t.Errorf("Expected %d files, got %d", len(testData), len(files))
+	}
+
+	// Importing again picks up new and renamed emoji without touching the votes
+	store.StoreTransaction(database.Transaction{Votes: map[string]int{thonk.ID: 3}})
+	if _, err := guild.GuildEmojiEdit(testGuild, thonk.ID, &discordgo.EmojiParams{Name: "thonking"}); err != nil {
+		t.Fatalf("Couldn't rename emoji: %v", err)
+	}
+	blob := guild.AddEmoji("blobdance", true)
+
+	report, err = im.Import(context.Background(), store)
+	if err != nil {
+		t.Fatalf("Second import failed: %v", err)
+	}
+	if report.Unchanged != 3 || report.Downloaded != 1 || report.Added != 1 {
+		t.Errorf("Expected only the new emoji to be downloaded and added, got %+v", report)
+	}
+	candidates = store.GetCandidates(true)
+	if len(candidates) != 4 {
+		t.Fatalf("Expected 4 candidates, got %+v", candidates)
+	}
+	for _, c := range candidates {
+		switch {
+		case c.ID == thonk.ID && c.Name != "thonking":
+			t.Errorf("Expected thonk to be renamed, got %+v", c)
+		case c.ID == blob.ID && c.Image != "battle/"+blob.ID+".gif":
+			t.Errorf("Expected the new emoji to be added, got %+v", c)
+		}
+	}
+	if votes := store.GetVotes(); votes[thonk.ID] != 3 {
+		t.Errorf("Expected the votes to be kept, got %v", votes)
+	}
+}
+
+func TestImportFailures(t *testing.T) {
+	guild := newTestGuild(t)
+	guild.AddEmoji("partyparrot", false)
+	missing := guild.AddEmoji("gone", false)
+	guild.SetImage(missing.ID+".png", "", nil)
+	down := guild.AddEmoji("down", false)
+	guild.FailImage(down.ID+".png", http.StatusServiceUnavailable, 100)
+	html := guild.AddEmoji("html", false)
+	guild.SetImage(html.ID+".png", "image/png", []byte("<html><body>Not an image</body></html>"))
+	huge := guild.AddEmoji("huge", false)
+	guild.SetImage(huge.ID+".png", "image/png", append(discordtest.PNG, make([]byte, 2048)...))
+	guild.AddEmoji("gif", true)
+
+	im := newTestImporter(t, guild)
+	store := newTestStore(t)
+
+	report, err := im.Import(context.Background(), store)
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		t.Fatalf("Expected a *DownloadError, got %v", err)
+	}
+	if n := len(store.GetCandidates(true)); n != 0 {
+		t.Errorf("Expected no candidates after a failed import, got %d", n)
+	}
+	if report.Downloaded != 2 {
+		t.Errorf("Expected the good emoji to be saved anyway, got %+v", report)
+	}
+
+	/* each row takes the form:
+	{failed emoji, requests made}
+	*/
+	testData := []struct {
+		id       string
+		requests int
+	}{
+		{missing.ID, 1},
+		{down.ID, 3},
+		{html.ID, 1},
+		{huge.ID, 1},
+	}
+
+	if len(downloadErr.Failures) != len(testData) {
+		t.Fatalf("Expected %d failures, got %v", len(testData), downloadErr)
+	}
+	for i, d := range testData {
+		if downloadErr.Failures[i].ID != d.id {
+			t.Errorf("Test[%d] expected %s to fail, got %+v", i, d.id, downloadErr.Failures[i])
+		}
+		if n := guild.ImageRequests(d.id + ".png"); n != d.requests {
+			t.Errorf("Test[%d] expected %d requests, got %d", i, d.requests, n)
+		}
+		if _, err := os.Stat(filepath.Join(im.imageDir, "battle", d.id+".png")); err == nil {
+			t.Errorf("Test[%d] expected nothing to be saved", i)
+		}
+	}
+}
+
+func TestImportUnreachable(t *testing.T) {
+	guild := newTestGuild(t)
+	thonk := guild.AddEmoji("thonk", false)
+	guild.Fail("GuildEmojis", errors.New("401 Unauthorized"))
+
+	im := newTestImporter(t, guild)
+	if _, err := im.Import(context.Background(), newTestStore(t)); err == nil {
+		t.Errorf("Expected an error when the emoji can't be listed")
+	}
+	if n := guild.ImageRequests(thonk.ID + ".png"); n != 0 {
+		t.Errorf("Expected nothing to be downloaded, got %d requests", n)
+	}
+}
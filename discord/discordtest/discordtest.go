@@ -0,0 +1,543 @@
+// Package discordtest is an in-process stand in for a Discord server and its CDN,
+// so the discord package can be tested offline
+package discordtest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Just enough of each format for http.DetectContentType
+var (
+	PNG = []byte("\x89PNG\r\n\x1a\n fake png")
+	GIF = []byte("GIF89a fake gif")
+)
+
+// firstID is where the made up IDs start, so they look like Discord's
+const firstID = 672547554004828180
+
+// image is a file served by the fake CDN
+type image struct {
+	contentType string
+	data        []byte
+	// failures is how many more requests get failStatus before it is served
+	failures   int
+	failStatus int
+}
+
+// Guild is a fake Discord server with one bot in it. It implements discord.Client.
+// Everything it is asked to do is recorded, and can be checked with its other methods.
+type Guild struct {
+	ID    string
+	BotID string
+
+	mu        sync.Mutex
+	nextID    int
+	emojis    []*discordgo.Emoji
+	images    map[string]*image
+	requests  map[string]int
+	messages  map[string]*discordgo.Message
+	channels  map[string][]string
+	pinned    map[string][]string
+	reactions map[string][]string
+	roles     map[string][]string
+	members   map[string]bool
+	dms       map[string]string
+	lookups   int
+	commands  []*discordgo.ApplicationCommand
+	responses []*discordgo.InteractionResponse
+	failures  map[string]error
+
+	cdn *httptest.Server
+}
+
+// New creates a fake guild and starts its CDN. Close it once the test is done.
+func New(guildID string) *Guild {
+	g := &Guild{
+		ID:        guildID,
+		nextID:    firstID,
+		images:    make(map[string]*image),
+		requests:  make(map[string]int),
+		messages:  make(map[string]*discordgo.Message),
+		channels:  make(map[string][]string),
+		pinned:    make(map[string][]string),
+		reactions: make(map[string][]string),
+		roles:     make(map[string][]string),
+		members:   make(map[string]bool),
+		dms:       make(map[string]string),
+		failures:  make(map[string]error),
+	}
+	g.BotID = g.newID()
+	g.cdn = httptest.NewServer(http.StripPrefix("/emojis/", http.HandlerFunc(g.serveImage)))
+	return g
+}
+
+// Close stops the CDN
+func (g *Guild) Close() {
+	g.cdn.Close()
+}
+
+// CDNURL is where the fake CDN is listening, for Discord.CDNURL
+func (g *Guild) CDNURL() string {
+	return g.cdn.URL
+}
+
+// newID makes up a new snowflake. The lock must be held, or g not yet shared.
+func (g *Guild) newID() string {
+	id := strconv.Itoa(g.nextID)
+	g.nextID++
+	return id
+}
+
+// AddEmoji adds a custom emoji to the guild, with a PNG or GIF on the CDN
+func (g *Guild) AddEmoji(name string, animated bool) *discordgo.Emoji {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	emoji := &discordgo.Emoji{ID: g.newID(), Name: name, Animated: animated, Available: true}
+	g.emojis = append(g.emojis, emoji)
+	if animated {
+		g.images[emoji.ID+".gif"] = &image{contentType: "image/gif", data: GIF}
+	} else {
+		g.images[emoji.ID+".png"] = &image{contentType: "image/png", data: PNG}
+	}
+	return emoji
+}
+
+// SetImage replaces what the CDN serves for file, e.g. "1234.png". A nil data makes it a 404.
+func (g *Guild) SetImage(file string, contentType string, data []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if data == nil {
+		delete(g.images, file)
+		return
+	}
+	g.images[file] = &image{contentType: contentType, data: data}
+}
+
+// FailImage makes the next n requests for file fail with status
+func (g *Guild) FailImage(file string, status int, n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if img, ok := g.images[file]; ok {
+		img.failures, img.failStatus = n, status
+	}
+}
+
+// ImageRequests is how many times file was asked for
+func (g *Guild) ImageRequests(file string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests[file]
+}
+
+func (g *Guild) serveImage(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	g.requests[r.URL.Path]++
+	img, ok := g.images[r.URL.Path]
+	var status int
+	if ok && img.failures > 0 {
+		img.failures--
+		status = img.failStatus
+	}
+	g.mu.Unlock()
+
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case status != 0:
+		http.Error(w, http.StatusText(status), status)
+	default:
+		w.Header().Set("Content-Type", img.contentType)
+		w.Write(img.data)
+	}
+}
+
+// Fail makes every call to the named method return err, until it is called again with a nil err
+func (g *Guild) Fail(method string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err == nil {
+		delete(g.failures, method)
+		return
+	}
+	g.failures[method] = err
+}
+
+// check returns the failure set for method, and an error if guildID isn't this guild.
+// The lock must be held.
+func (g *Guild) check(method string, guildID string) error {
+	if err := g.failures[method]; err != nil {
+		return err
+	}
+	if guildID != "" && guildID != g.ID {
+		return fmt.Errorf("unknown guild %s", guildID)
+	}
+	return nil
+}
+
+// Emoji returns the emoji with id, or nil if there isn't one
+func (g *Guild) Emoji(id string) *discordgo.Emoji {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, e := range g.emojis {
+		if e.ID == id {
+			copy := *e
+			return &copy
+		}
+	}
+	return nil
+}
+
+// Messages returns everything posted in a channel, oldest first
+func (g *Guild) Messages(channelID string) []*discordgo.Message {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var msgs []*discordgo.Message
+	for _, id := range g.channels[channelID] {
+		msgs = append(msgs, g.messages[id])
+	}
+	return msgs
+}
+
+// Post adds a message to a channel as if a member had sent it
+func (g *Guild) Post(channelID string, authorID string, content string) *discordgo.Message {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.post(channelID, authorID, content)
+}
+
+// post adds a message to a channel. The lock must be held.
+func (g *Guild) post(channelID string, authorID string, content string) *discordgo.Message {
+	msg := &discordgo.Message{
+		ID:        g.newID(),
+		ChannelID: channelID,
+		GuildID:   g.ID,
+		Content:   content,
+		Author:    &discordgo.User{ID: authorID},
+	}
+	g.messages[msg.ID] = msg
+	g.channels[channelID] = append(g.channels[channelID], msg.ID)
+	return msg
+}
+
+// Pinned returns the IDs of the pinned messages in a channel
+func (g *Guild) Pinned(channelID string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.pinned[channelID]...)
+}
+
+// Reactions returns the reactions on a message, as "userID emoji" in the order they were added
+func (g *Guild) Reactions(messageID string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.reactions[messageID]...)
+}
+
+// React adds a member's reaction to a message and returns the event Discord would send the bot
+func (g *Guild) React(messageID string, userID string, emoji *discordgo.Emoji) *discordgo.MessageReaction {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	msg := g.messages[messageID]
+	g.reactions[messageID] = append(g.reactions[messageID], userID+" "+emoji.APIName())
+	return &discordgo.MessageReaction{UserID: userID, MessageID: messageID, Emoji: *emoji, ChannelID: msg.ChannelID, GuildID: g.ID}
+}
+
+// AddMember adds a user to the guild with some roles
+func (g *Guild) AddMember(userID string, roleIDs ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members[userID] = true
+	g.roles[userID] = append(g.roles[userID], roleIDs...)
+}
+
+// MemberLookups is how many times members were looked up
+func (g *Guild) MemberLookups() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lookups
+}
+
+// Roles returns the roles given to a member
+func (g *Guild) Roles(userID string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.roles[userID]...)
+}
+
+// Commands returns the application commands registered in the guild
+func (g *Guild) Commands() []*discordgo.ApplicationCommand {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*discordgo.ApplicationCommand(nil), g.commands...)
+}
+
+// Responses returns every reply to an interaction, oldest first
+func (g *Guild) Responses() []*discordgo.InteractionResponse {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*discordgo.InteractionResponse(nil), g.responses...)
+}
+
+// Command returns the interaction Discord would send the bot when userID runs a command.
+// Options are given as name, value pairs.
+func (g *Guild) Command(userID string, autocomplete bool, name string, options ...string) *discordgo.Interaction {
+	data := discordgo.ApplicationCommandInteractionData{Name: name}
+	for i := 0; i+1 < len(options); i += 2 {
+		data.Options = append(data.Options, &discordgo.ApplicationCommandInteractionDataOption{
+			Name:    options[i],
+			Type:    discordgo.ApplicationCommandOptionString,
+			Value:   options[i+1],
+			Focused: autocomplete,
+		})
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	i := &discordgo.Interaction{
+		ID:      g.newID(),
+		Type:    discordgo.InteractionApplicationCommand,
+		GuildID: g.ID,
+		Member:  &discordgo.Member{User: &discordgo.User{ID: userID}},
+		Data:    data,
+	}
+	if autocomplete {
+		i.Type = discordgo.InteractionApplicationCommandAutocomplete
+	}
+	return i
+}
+
+// GuildEmojis lists the guild's custom emoji
+func (g *Guild) GuildEmojis(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Emoji, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("GuildEmojis", guildID); err != nil {
+		return nil, err
+	}
+	var emojis []*discordgo.Emoji
+	for _, e := range g.emojis {
+		copy := *e
+		emojis = append(emojis, &copy)
+	}
+	return emojis, nil
+}
+
+// GuildEmojiEdit renames an emoji
+func (g *Guild) GuildEmojiEdit(guildID, emojiID string, data *discordgo.EmojiParams, options ...discordgo.RequestOption) (*discordgo.Emoji, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("GuildEmojiEdit", guildID); err != nil {
+		return nil, err
+	}
+	for _, e := range g.emojis {
+		if e.ID == emojiID {
+			e.Name = data.Name
+			copy := *e
+			return &copy, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown emoji %s", emojiID)
+}
+
+// GuildEmojiDelete removes an emoji, leaving its image on the CDN
+func (g *Guild) GuildEmojiDelete(guildID, emojiID string, options ...discordgo.RequestOption) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("GuildEmojiDelete", guildID); err != nil {
+		return err
+	}
+	for i, e := range g.emojis {
+		if e.ID == emojiID {
+			g.emojis = append(g.emojis[:i], g.emojis[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown emoji %s", emojiID)
+}
+
+// GuildMember looks up a member added with AddMember. Anyone else gets the error Discord gives for an unknown member.
+func (g *Guild) GuildMember(guildID, userID string, options ...discordgo.RequestOption) (*discordgo.Member, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lookups++
+	if err := g.check("GuildMember", guildID); err != nil {
+		return nil, err
+	}
+	if !g.members[userID] {
+		return nil, &discordgo.RESTError{
+			Response:     &http.Response{Status: "404 Not Found", StatusCode: http.StatusNotFound},
+			ResponseBody: []byte(`{"message": "Unknown Member", "code": 10007}`),
+			Message:      &discordgo.APIErrorMessage{Code: discordgo.ErrCodeUnknownMember, Message: "Unknown Member"},
+		}
+	}
+	return &discordgo.Member{
+		GuildID: g.ID,
+		User:    &discordgo.User{ID: userID},
+		Roles:   append([]string(nil), g.roles[userID]...),
+	}, nil
+}
+
+// GuildMemberRoleAdd gives a member a role
+func (g *Guild) GuildMemberRoleAdd(guildID, userID, roleID string, options ...discordgo.RequestOption) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("GuildMemberRoleAdd", guildID); err != nil {
+		return err
+	}
+	g.roles[userID] = append(g.roles[userID], roleID)
+	return nil
+}
+
+// UserChannelCreate opens a direct message channel with a member added with AddMember.
+// Anyone else gets the error Discord gives when the bot can't message them.
+func (g *Guild) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("UserChannelCreate", ""); err != nil {
+		return nil, err
+	}
+	if !g.members[recipientID] {
+		return nil, &discordgo.RESTError{
+			Response:     &http.Response{Status: "403 Forbidden", StatusCode: http.StatusForbidden},
+			ResponseBody: []byte(`{"message": "Cannot send messages to this user", "code": 50007}`),
+			Message:      &discordgo.APIErrorMessage{Code: discordgo.ErrCodeCannotSendMessagesToThisUser, Message: "Cannot send messages to this user"},
+		}
+	}
+	if _, ok := g.dms[recipientID]; !ok {
+		g.dms[recipientID] = g.newID()
+	}
+	return &discordgo.Channel{ID: g.dms[recipientID], Type: discordgo.ChannelTypeDM, Recipients: []*discordgo.User{{ID: recipientID}}}, nil
+}
+
+// DMs returns the direct messages sent to a user, oldest first
+func (g *Guild) DMs(userID string) []*discordgo.Message {
+	g.mu.Lock()
+	channelID, ok := g.dms[userID]
+	g.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return g.Messages(channelID)
+}
+
+// ChannelMessageSend posts a message as the bot
+func (g *Guild) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("ChannelMessageSend", ""); err != nil {
+		return nil, err
+	}
+	msg := *g.post(channelID, g.BotID, content)
+	return &msg, nil
+}
+
+// ChannelMessage looks up a message
+func (g *Guild) ChannelMessage(channelID, messageID string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("ChannelMessage", ""); err != nil {
+		return nil, err
+	}
+	msg, ok := g.messages[messageID]
+	if !ok || msg.ChannelID != channelID {
+		return nil, fmt.Errorf("unknown message %s", messageID)
+	}
+	copy := *msg
+	return &copy, nil
+}
+
+// ChannelMessagePin pins a message
+func (g *Guild) ChannelMessagePin(channelID, messageID string, options ...discordgo.RequestOption) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("ChannelMessagePin", ""); err != nil {
+		return err
+	}
+	if msg, ok := g.messages[messageID]; !ok || msg.ChannelID != channelID {
+		return fmt.Errorf("unknown message %s", messageID)
+	}
+	g.pinned[channelID] = append(g.pinned[channelID], messageID)
+	return nil
+}
+
+// MessageReactionAdd adds the bot's reaction to a message. emojiID is name:id, as discordgo.Emoji.APIName gives.
+func (g *Guild) MessageReactionAdd(channelID, messageID, emojiID string, options ...discordgo.RequestOption) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("MessageReactionAdd", ""); err != nil {
+		return err
+	}
+	if _, ok := g.messages[messageID]; !ok {
+		return fmt.Errorf("unknown message %s", messageID)
+	}
+	g.reactions[messageID] = append(g.reactions[messageID], g.BotID+" "+emojiID)
+	return nil
+}
+
+// MessageReactionRemove takes away a member's reaction
+func (g *Guild) MessageReactionRemove(channelID, messageID, emojiID, userID string, options ...discordgo.RequestOption) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("MessageReactionRemove", ""); err != nil {
+		return err
+	}
+	reactions := g.reactions[messageID]
+	for i, r := range reactions {
+		if r == userID+" "+emojiID {
+			g.reactions[messageID] = append(reactions[:i], reactions[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no reaction %s by %s on %s", emojiID, userID, messageID)
+}
+
+// ApplicationCommandCreate registers a command in the guild
+func (g *Guild) ApplicationCommandCreate(appID string, guildID string, cmd *discordgo.ApplicationCommand, options ...discordgo.RequestOption) (*discordgo.ApplicationCommand, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("ApplicationCommandCreate", guildID); err != nil {
+		return nil, err
+	}
+	if appID != g.BotID {
+		return nil, fmt.Errorf("unknown application %s", appID)
+	}
+	created := *cmd
+	created.ID, created.ApplicationID, created.GuildID = g.newID(), appID, guildID
+	g.commands = append(g.commands, &created)
+	return &created, nil
+}
+
+// InteractionRespond records the reply to an interaction
+func (g *Guild) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.check("InteractionRespond", ""); err != nil {
+		return err
+	}
+	g.responses = append(g.responses, resp)
+	return nil
+}
+
+// EmojiImage starts downloading an emoji image from the fake CDN
+func (g *Guild) EmojiImage(ctx context.Context, file string) (*http.Response, error) {
+	g.mu.Lock()
+	err := g.check("EmojiImage", "")
+	g.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(g.cdn.URL, "/")+"/emojis/"+file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return g.cdn.Client().Do(req)
+}
@@ -0,0 +1,31 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// SendLoginLink sends a one-time login link to the Discord user userID in a direct message from the bot.
+// Discord only lets the bot message users who share a server with it and accept messages from its members.
+func SendLoginLink(ctx context.Context, client Client, userID string, electionName string, link string, expires time.Time) error {
+	if !snowflake.MatchString(userID) {
+		return fmt.Errorf("%q is not a Discord user ID", userID)
+	}
+	if electionName == "" {
+		electionName = "the emoji battle"
+	}
+
+	channel, err := client.UserChannelCreate(userID, discordgo.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("unable to message %s: %v", userID, err)
+	}
+	content := fmt.Sprintf("Here is your link to vote in %s. It logs you in once and works until <t:%d:f>, so keep it to yourself:\n%s",
+		electionName, expires.Unix(), link)
+	if _, err := client.ChannelMessageSend(channel.ID, content, discordgo.WithContext(ctx)); err != nil {
+		return fmt.Errorf("unable to message %s: %v", userID, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package discord
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendLoginLink(t *testing.T) {
+	guild := newTestGuild(t)
+	guild.AddMember("80351110224678912")
+	expires := time.Date(2030, 7, 5, 5, 45, 0, 0, time.UTC)
+	link := "https://vote.example.com/login/link?token=abc"
+
+	/* each row takes the form:
+	{user ID, expected to be sent}
+	*/
+	testData := []struct {
+		userID string
+		sent   bool
+	}{
+		{"80351110224678912", true},
+		// Not in the server, so the bot can't message them
+		{"80351110224678913", false},
+		{"billy", false},
+	}
+
+	for i, d := range testData {
+		err := SendLoginLink(context.Background(), guild, d.userID, "Emoji Battle", link, expires)
+		if sent := err == nil; sent != d.sent {
+			t.Errorf("Test[%d] expected sent %v, got %v", i, d.sent, err)
+		}
+	}
+
+	dms := guild.DMs("80351110224678912")
+	if len(dms) != 1 {
+		t.Fatalf("Expected one DM, got %d", len(dms))
+	}
+	for _, text := range []string{"Emoji Battle", link, "<t:1909460700:f>"} {
+		if !strings.Contains(dms[0].Content, text) {
+			t.Errorf("Expected the DM to contain %q, got %q", text, dms[0].Content)
+		}
+	}
+}
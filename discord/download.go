@@ -0,0 +1,201 @@
+package discord
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Failure is an emoji which couldn't be downloaded
+type Failure struct {
+	ID   string
+	Name string
+	Err  error
+}
+
+// DownloadError lists every emoji which couldn't be downloaded
+type DownloadError struct {
+	Failures []Failure
+}
+
+func (e *DownloadError) Error() string {
+	lines := []string{fmt.Sprintf("%d emoji couldn't be downloaded:", len(e.Failures))}
+	for _, f := range e.Failures {
+		lines = append(lines, fmt.Sprintf("%s (%s): %v", f.Name, f.ID, f.Err))
+	}
+	return strings.Join(lines, "\n  ")
+}
+
+// Report is what happened to each emoji in a download
+type Report struct {
+	// Downloaded were new or changed and have been saved
+	Downloaded int
+	// Unchanged were already saved with the same contents, so were left alone
+	Unchanged int
+	// Added are the candidates Import added to the store, the others were already there
+	Added    int
+	Failures []Failure
+}
+
+// Err returns a *DownloadError if any emoji failed, otherwise nil
+func (r Report) Err() error {
+	if len(r.Failures) == 0 {
+		return nil
+	}
+	return &DownloadError{Failures: r.Failures}
+}
+
+// errPermanent marks a download error which won't go away by trying again
+type errPermanent struct{ error }
+
+// emojiFile is the name an emoji is saved under, which is also its name on the CDN
+func emojiFile(emoji *discordgo.Emoji) string {
+	if emoji.Animated {
+		return emoji.ID + ".gif"
+	}
+	return emoji.ID + ".png"
+}
+
+// downloadAll saves every emoji into dir, a few at a time.
+// ok reports which emoji were saved, in the same order as emojis.
+func (im *Importer) downloadAll(ctx context.Context, dir string, emojis []*discordgo.Emoji) (report Report, ok []bool) {
+	ok = make([]bool, len(emojis))
+	unchanged := make([]bool, len(emojis))
+	errs := make([]error, len(emojis))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, im.downloads)
+	for i, emoji := range emojis {
+		wg.Add(1)
+		go func(i int, emoji *discordgo.Emoji) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			unchanged[i], errs[i] = im.download(ctx, filepath.Join(dir, emojiFile(emoji)), emoji)
+			ok[i] = errs[i] == nil
+		}(i, emoji)
+	}
+	wg.Wait()
+
+	// Tally up afterwards so the failures are in a stable order
+	for i, emoji := range emojis {
+		switch {
+		case errs[i] != nil:
+			report.Failures = append(report.Failures, Failure{ID: emoji.ID, Name: emoji.Name, Err: errs[i]})
+		case unchanged[i]:
+			report.Unchanged++
+		default:
+			report.Downloaded++
+		}
+	}
+	return report, ok
+}
+
+// download fetches one emoji, trying again with a growing delay after network or server errors.
+// The file is only written if its contents changed, in which case unchanged is false.
+func (im *Importer) download(ctx context.Context, filename string, emoji *discordgo.Emoji) (unchanged bool, err error) {
+	var data []byte
+	delay := im.backoff
+	for attempt := 0; ; attempt++ {
+		data, err = im.fetch(ctx, emojiFile(emoji), emoji.Animated)
+		var permanent errPermanent
+		if err == nil || errors.As(err, &permanent) || attempt >= im.retries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if old, err := os.ReadFile(filename); err == nil && sha256.Sum256(old) == sha256.Sum256(data) {
+		return true, nil
+	}
+	return false, writeFileAtomic(filename, data)
+}
+
+// fetch makes one attempt at downloading an emoji image from the CDN, and checks it is one
+func (im *Importer) fetch(ctx context.Context, file string, animated bool) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, im.timeout)
+	defer cancel()
+
+	resp, err := im.client.EmojiImage(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, fmt.Errorf("the CDN returned %s for %s", resp.Status, file)
+	default:
+		return nil, errPermanent{fmt.Errorf("the CDN returned %s for %s", resp.Status, file)}
+	}
+
+	want := "image/png"
+	if animated {
+		want = "image/gif"
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != want {
+		return nil, errPermanent{fmt.Errorf("expected %s, got %q", want, resp.Header.Get("Content-Type"))}
+	}
+	if resp.ContentLength > int64(im.maxSize) {
+		return nil, errPermanent{fmt.Errorf("%d bytes is bigger than the %d allowed", resp.ContentLength, im.maxSize)}
+	}
+
+	// Read one byte more than allowed, to tell when the body is too big without a Content-Length
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(im.maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > im.maxSize {
+		return nil, errPermanent{fmt.Errorf("image is bigger than the %d bytes allowed", im.maxSize)}
+	}
+	// Don't trust the header alone, an error page could be labelled as an image
+	if got := http.DetectContentType(data); got != want {
+		return nil, errPermanent{fmt.Errorf("expected %s, the data looks like %s", want, got)}
+	}
+	return data, nil
+}
+
+// writeFileAtomic replaces filename with data, so it never holds half an image
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, bytes.NewReader(data)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes the file private, but images are served to everyone
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,302 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ErrVotingClosed is returned by a VoteFunc outside of the voting phase
+var ErrVotingClosed = errors.New("voting is closed")
+
+// ThrottledError is returned by a VoteFunc when the voter has used up their rate limit
+type ThrottledError struct {
+	Wait time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("voting too fast, wait %s", e.Wait)
+}
+
+// VoteFunc records one vote for candidate by the Discord user userID,
+// under the same rules as votes from the web
+type VoteFunc func(userID string, candidate string) error
+
+// ballotHeading starts every ballot message, so they can be told apart from the announcements
+const ballotHeading = "🗳️ **Ballot**"
+
+// maxReactions is how many different reactions Discord allows on one message
+const maxReactions = 20
+
+// maxChoices is how many suggestions Discord shows while typing a command option
+const maxChoices = 25
+
+// voteCommand is the /vote slash command registered in the guild
+var voteCommand = &discordgo.ApplicationCommand{
+	Name:        "vote",
+	Description: "Vote for a candidate in the emoji battle",
+	Options: []*discordgo.ApplicationCommandOption{{
+		Type:         discordgo.ApplicationCommandOptionString,
+		Name:         "emoji",
+		Description:  "The emoji to vote for",
+		Required:     true,
+		Autocomplete: true,
+	}},
+}
+
+// Voting lets members of the guild vote from Discord, with the /vote command
+// or by reacting to one of the bot's ballot messages
+type Voting struct {
+	client    Client
+	guildID   string
+	channelID string
+	store     *database.Store
+	vote      VoteFunc
+	// botID is the bot's own user ID, known once connected
+	botID string
+
+	// session receives the interactions and reactions, it is nil in tests
+	session *Session
+
+	mu sync.Mutex
+	// ballots caches whether each message reacted to is a ballot
+	ballots map[string]bool
+}
+
+// NewVoting creates a Voting which connects to Discord with session.
+// Ballots are posted to Discord.AnnounceChannel.
+func NewVoting(session *Session, conf config.Config, store *database.Store, vote VoteFunc) *Voting {
+	session.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessageReactions
+
+	v := newVoting(session, conf.GuildID, conf.Discord.AnnounceChannel, store, vote)
+	v.session = session
+	return v
+}
+
+func newVoting(client Client, guildID string, channelID string, store *database.Store, vote VoteFunc) *Voting {
+	return &Voting{
+		client:    client,
+		guildID:   guildID,
+		channelID: channelID,
+		store:     store,
+		vote:      vote,
+		ballots:   make(map[string]bool),
+	}
+}
+
+// Open connects to Discord, registers the /vote command and starts handling votes
+func (v *Voting) Open() error {
+	v.session.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) { v.handleInteraction(i.Interaction) })
+	v.session.AddHandler(func(s *discordgo.Session, r *discordgo.MessageReactionAdd) { v.handleReaction(r.MessageReaction) })
+	if err := v.session.Open(); err != nil {
+		return fmt.Errorf("Unable to connect to Discord: %v", err)
+	}
+	v.botID = v.session.State.User.ID
+
+	if err := v.register(); err != nil {
+		v.session.Close()
+		return err
+	}
+	return nil
+}
+
+// register adds the /vote command to the guild
+func (v *Voting) register() error {
+	if _, err := v.client.ApplicationCommandCreate(v.botID, v.guildID, voteCommand); err != nil {
+		return fmt.Errorf("Unable to register the /vote command in guild %s: %v", v.guildID, err)
+	}
+	return nil
+}
+
+// Close disconnects from Discord. The /vote command stays registered, and says voting is closed.
+func (v *Voting) Close() error {
+	return v.session.Close()
+}
+
+// PostBallots posts ballot messages with a reaction for every candidate imported from Discord.
+// Discord limits how many reactions a message can have, so there is one ballot for every maxReactions candidates.
+func (v *Voting) PostBallots(ctx context.Context, candidates []database.Candidate) error {
+	var emojis []database.Candidate
+	for _, can := range candidates {
+		if can.Active && isEmoji(can) {
+			emojis = append(emojis, can)
+		}
+	}
+
+	for start := 0; start < len(emojis); start += maxReactions {
+		end := min(start+maxReactions, len(emojis))
+		content := fmt.Sprintf("%s %d/%d\nReact with an emoji to vote for it. Your reaction is taken away once the vote is counted, so you can vote again.",
+			ballotHeading, start/maxReactions+1, (len(emojis)+maxReactions-1)/maxReactions)
+
+		msg, err := v.client.ChannelMessageSend(v.channelID, content, discordgo.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("Unable to post a ballot to channel %s: %v", v.channelID, err)
+		}
+		v.setBallot(msg.ID, true)
+
+		for _, can := range emojis[start:end] {
+			if err := v.client.MessageReactionAdd(v.channelID, msg.ID, can.Name+":"+can.ID, discordgo.WithContext(ctx)); err != nil {
+				return fmt.Errorf("Unable to add %s to the ballot: %v", can.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (v *Voting) handleInteraction(i *discordgo.Interaction) {
+	if i.Type != discordgo.InteractionApplicationCommand && i.Type != discordgo.InteractionApplicationCommandAutocomplete {
+		return
+	}
+	data := i.ApplicationCommandData()
+	if data.Name != voteCommand.Name || len(data.Options) == 0 {
+		return
+	}
+	choice := data.Options[0].StringValue()
+
+	var resp *discordgo.InteractionResponse
+	if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		resp = &discordgo.InteractionResponse{
+			Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+			Data: &discordgo.InteractionResponseData{Choices: v.suggest(choice)},
+		}
+	} else {
+		userID := ""
+		if i.Member != nil && i.Member.User != nil {
+			userID = i.Member.User.ID
+		}
+		// Only the voter sees the reply
+		resp = &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: v.castVote(i.GuildID, userID, choice),
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		}
+	}
+
+	if err := v.client.InteractionRespond(i, resp); err != nil {
+		slog.Error("Unable to reply to a Discord command", "command", data.Name, "error", err)
+	}
+}
+
+func (v *Voting) handleReaction(r *discordgo.MessageReaction) {
+	if r.UserID == v.botID || r.ChannelID != v.channelID || !v.isBallot(r.ChannelID, r.MessageID) {
+		return
+	}
+
+	reply := v.castVote(r.GuildID, r.UserID, r.Emoji.ID)
+	slog.Info("Vote by reaction", "voter", r.UserID, "emoji", r.Emoji.ID, "result", reply)
+
+	// Taking the reaction away lets it be used for the next vote
+	if err := v.client.MessageReactionRemove(r.ChannelID, r.MessageID, r.Emoji.APIName(), r.UserID); err != nil {
+		slog.Warn("Unable to remove a vote reaction, does the bot have Manage Messages?", "error", err)
+	}
+}
+
+// isBallot checks whether a message is one of our ballots, asking Discord the first time a message is seen
+func (v *Voting) isBallot(channelID string, messageID string) bool {
+	v.mu.Lock()
+	ballot, ok := v.ballots[messageID]
+	v.mu.Unlock()
+	if ok {
+		return ballot
+	}
+
+	msg, err := v.client.ChannelMessage(channelID, messageID)
+	if err != nil {
+		slog.Warn("Unable to look up a reacted to message", "message", messageID, "error", err)
+		return false
+	}
+	ballot = msg.Author != nil && msg.Author.ID == v.botID && strings.HasPrefix(msg.Content, ballotHeading)
+	v.setBallot(messageID, ballot)
+	return ballot
+}
+
+func (v *Voting) setBallot(messageID string, ballot bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.ballots[messageID] = ballot
+}
+
+// castVote votes for the candidate the voter chose and returns the reply to show them
+func (v *Voting) castVote(guildID string, userID string, choice string) string {
+	if guildID != v.guildID || userID == "" {
+		return "Only members of the battle's server can vote."
+	}
+
+	can, ok := v.findCandidate(choice)
+	if !ok {
+		return fmt.Sprintf("There is no candidate called %q.", choice)
+	}
+
+	err := v.vote(userID, can.ID)
+	var throttled *ThrottledError
+	switch {
+	case err == nil:
+		return fmt.Sprintf("You voted for %s.", Render(can))
+	case errors.Is(err, ErrVotingClosed):
+		return "Voting is closed right now."
+	case errors.As(err, &throttled):
+		return fmt.Sprintf("You're voting too fast, try again in %d seconds.", int(math.Ceil(throttled.Wait.Seconds())))
+	case errors.Is(err, database.ErrCandidateEliminated):
+		return fmt.Sprintf("%s has already been eliminated.", Render(can))
+	case errors.Is(err, database.ErrUnknownCandidate):
+		return fmt.Sprintf("There is no candidate called %q.", choice)
+	}
+	return "Your vote couldn't be recorded, please try again."
+}
+
+// findCandidate works out which candidate was chosen. choice can be a candidate's ID or name,
+// with or without colons, or a custom emoji as Discord writes it in a message, e.g. <:thonk:1234>.
+func (v *Voting) findCandidate(choice string) (database.Candidate, bool) {
+	choice = strings.TrimSpace(choice)
+	if strings.HasPrefix(choice, "<") && strings.HasSuffix(choice, ">") {
+		parts := strings.Split(strings.Trim(choice, "<>"), ":")
+		choice = parts[len(parts)-1]
+	}
+	name := strings.Trim(choice, ":")
+
+	candidates := v.store.GetCandidates(true)
+	for _, can := range candidates {
+		if can.ID == choice {
+			return can, true
+		}
+	}
+	for _, can := range candidates {
+		if strings.EqualFold(can.DisplayName(), name) {
+			return can, true
+		}
+	}
+	return database.Candidate{}, false
+}
+
+// suggest lists the candidates still in the battle whose name contains what has been typed so far
+func (v *Voting) suggest(typed string) []*discordgo.ApplicationCommandOptionChoice {
+	typed = strings.ToLower(strings.Trim(typed, ": "))
+
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	for _, can := range v.store.GetCandidates(false) {
+		if len(choices) == maxChoices {
+			break
+		}
+		if strings.Contains(strings.ToLower(can.DisplayName()), typed) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: can.DisplayName(), Value: can.ID})
+		}
+	}
+	return choices
+}
+
+// isEmoji checks whether a candidate was imported from Discord, so can be used as a reaction
+func isEmoji(can database.Candidate) bool {
+	return snowflake.MatchString(can.ID) && can.Name != ""
+}
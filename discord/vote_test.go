@@ -0,0 +1,213 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"Emoji-battle-royale/database"
+	"Emoji-battle-royale/discord/discordtest"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// newTestVoting creates a Voting in a fake guild, over a store with a few candidates, one of them eliminated.
+// Votes go through result, or straight into the store if it returns nil.
+func newTestVoting(t *testing.T, result func(userID string, candidate string) error) (*Voting, *discordtest.Guild) {
+	store, err := database.CreateOrOverwriteDB(filepath.Join(t.TempDir(), "vote.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	err = store.InitializeCandidates([]database.Candidate{
+		{ID: "672547554004828180", CandidateInfo: database.CandidateInfo{Name: "thonk"}, Active: true},
+		{ID: "672547554004828181", CandidateInfo: database.CandidateInfo{Name: "partyparrot", Tags: []string{AnimatedTag}}, Active: true},
+		{ID: "672547554004828182", CandidateInfo: database.CandidateInfo{Name: "sadparrot"}, Active: true},
+	})
+	if err != nil {
+		t.Fatalf("Couldn't add candidates: %v", err)
+	}
+	store.EliminateCandidate("672547554004828182")
+
+	guild := newTestGuild(t)
+	v := newVoting(guild, testGuild, "channel", store, func(userID string, candidate string) error {
+		if err := result(userID, candidate); err != nil {
+			return err
+		}
+		return store.StoreTransaction(database.Transaction{UserID: userID, Votes: database.Votes{candidate: 1}})
+	})
+	v.botID = guild.BotID
+	return v, guild
+}
+
+func TestCastVote(t *testing.T) {
+	var closed bool
+	v, _ := newTestVoting(t, func(userID string, candidate string) error {
+		switch {
+		case closed:
+			return ErrVotingClosed
+		case userID == "greedy":
+			return &ThrottledError{Wait: 1500 * time.Millisecond}
+		}
+		return nil
+	})
+
+	/* each row takes the form:
+	{guild, user, choice, start of the reply}
+	*/
+	testData := []struct {
+		guild, user, choice string
+		reply               string
+	}{
+		{testGuild, "80351110224678912", "thonk", "You voted for <:thonk:672547554004828180>"},
+		{testGuild, "80351110224678912", ":PartyParrot:", "You voted for <a:partyparrot:672547554004828181>"},
+		{testGuild, "80351110224678912", "<:thonk:672547554004828180>", "You voted for <:thonk:672547554004828180>"},
+		{testGuild, "80351110224678912", "672547554004828181", "You voted for <a:partyparrot:672547554004828181>"},
+		{testGuild, "80351110224678912", "sadparrot", "<:sadparrot:672547554004828182> has already been eliminated"},
+		{testGuild, "80351110224678912", "nope", `There is no candidate called "nope"`},
+		{testGuild, "greedy", "thonk", "You're voting too fast, try again in 2 seconds"},
+		{"another guild", "80351110224678912", "thonk", "Only members of the battle's server can vote"},
+		{testGuild, "", "thonk", "Only members of the battle's server can vote"},
+	}
+
+	for i, d := range testData {
+		if reply := v.castVote(d.guild, d.user, d.choice); !strings.HasPrefix(reply, d.reply) {
+			t.Errorf("Test[%d] expected %q, got %q", i, d.reply, reply)
+		}
+	}
+
+	votes := v.store.GetVotes()
+	if votes["672547554004828180"] != 2 || votes["672547554004828181"] != 2 || votes["672547554004828182"] != 0 {
+		t.Errorf("Unexpected totals %v", votes)
+	}
+	for _, tr := range v.store.GetAllTransactions() {
+		if tr.UserID != "80351110224678912" {
+			t.Errorf("Expected every vote to be attributed to the Discord user, got %q", tr.UserID)
+		}
+	}
+
+	closed = true
+	if reply := v.castVote(testGuild, "80351110224678912", "thonk"); reply != "Voting is closed right now." {
+		t.Errorf("Expected voting to be closed, got %q", reply)
+	}
+}
+
+func TestCastVoteFailure(t *testing.T) {
+	v, _ := newTestVoting(t, func(userID string, candidate string) error {
+		return errors.New("database is on fire")
+	})
+	if reply := v.castVote(testGuild, "80351110224678912", "thonk"); !strings.Contains(reply, "couldn't be recorded") {
+		t.Errorf("Expected internal errors to be hidden, got %q", reply)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	v, _ := newTestVoting(t, func(userID string, candidate string) error { return nil })
+
+	/* each row takes the form:
+	{typed, expected suggestions}
+	*/
+	testData := []struct {
+		typed    string
+		expected []string
+	}{
+		{"", []string{"thonk", "partyparrot"}},
+		{"PARROT", []string{"partyparrot"}},
+		{":tho", []string{"thonk"}},
+		{"zzz", nil},
+	}
+
+	for i, d := range testData {
+		choices := v.suggest(d.typed)
+		var names []string
+		for _, c := range choices {
+			names = append(names, c.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(d.expected, ",") {
+			t.Errorf("Test[%d] expected %v, got %v", i, d.expected, names)
+		}
+	}
+}
+
+func TestBallots(t *testing.T) {
+	v, guild := newTestVoting(t, func(userID string, candidate string) error { return nil })
+
+	if err := v.PostBallots(context.Background(), v.store.GetCandidates(true)); err != nil {
+		t.Fatalf("PostBallots failed: %v", err)
+	}
+	msgs := guild.Messages("channel")
+	if len(msgs) != 1 || !strings.HasPrefix(msgs[0].Content, ballotHeading) {
+		t.Fatalf("Expected one ballot, got %v", msgs)
+	}
+	ballot := msgs[0].ID
+	// The eliminated candidate isn't on the ballot
+	reactions := guild.Reactions(ballot)
+	if strings.Join(reactions, ",") != guild.BotID+" thonk:672547554004828180,"+guild.BotID+" partyparrot:672547554004828181" {
+		t.Errorf("Unexpected reactions on the ballot %v", reactions)
+	}
+
+	// A forgotten cache is refilled by asking Discord
+	v.ballots = make(map[string]bool)
+	other := guild.Post("channel", "80351110224678913", ballotHeading+" forged")
+	thonk := &discordgo.Emoji{ID: "672547554004828180", Name: "thonk"}
+
+	/* each row takes the form:
+	{message, voter, counted}
+	*/
+	testData := []struct {
+		message, user string
+		counted       bool
+	}{
+		{ballot, "80351110224678912", true},
+		{ballot, "80351110224678912", true},
+		{other.ID, "80351110224678912", false},
+		{ballot, guild.BotID, false},
+	}
+
+	for i, d := range testData {
+		before := v.store.GetVotes()["672547554004828180"]
+		v.handleReaction(guild.React(d.message, d.user, thonk))
+		if counted := v.store.GetVotes()["672547554004828180"] > before; counted != d.counted {
+			t.Errorf("Test[%d] expected counted to be %v", i, d.counted)
+		}
+		// Counted reactions are taken away so they can be used again
+		left := strings.Contains(strings.Join(guild.Reactions(d.message), ","), d.user+" thonk:")
+		if left == d.counted {
+			t.Errorf("Test[%d] expected the reaction to be left %v, got %v", i, !d.counted, guild.Reactions(d.message))
+		}
+	}
+}
+
+func TestVoteCommand(t *testing.T) {
+	v, guild := newTestVoting(t, func(userID string, candidate string) error { return nil })
+
+	v.handleInteraction(guild.Command("80351110224678912", true, "vote", "emoji", "parrot"))
+	v.handleInteraction(guild.Command("80351110224678912", false, "vote", "emoji", "672547554004828181"))
+	v.handleInteraction(guild.Command("80351110224678912", false, "other", "emoji", "thonk"))
+
+	responses := guild.Responses()
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(responses))
+	}
+	if choices := responses[0].Data.Choices; len(choices) != 1 || choices[0].Value != "672547554004828181" {
+		t.Errorf("Expected partyparrot to be suggested, got %v", choices)
+	}
+	reply := responses[1].Data
+	if !strings.HasPrefix(reply.Content, "You voted for <a:partyparrot:672547554004828181>") || reply.Flags != discordgo.MessageFlagsEphemeral {
+		t.Errorf("Expected a private reply to the vote, got %+v", reply)
+	}
+	if votes := v.store.GetVotes(); votes["672547554004828181"] != 1 || votes["672547554004828180"] != 0 {
+		t.Errorf("Unexpected totals %v", votes)
+	}
+
+	if err := v.register(); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	if commands := guild.Commands(); len(commands) != 1 || commands[0].Name != "vote" || commands[0].GuildID != testGuild {
+		t.Errorf("Expected /vote to be registered in the guild, got %v", commands)
+	}
+}
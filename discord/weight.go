@@ -0,0 +1,80 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"Emoji-battle-royale/config"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// weightTTL is how long a member's weight is remembered, so not every vote has to ask Discord
+const weightTTL = time.Minute
+
+// cachedWeight is a weight looked up earlier, and when to look it up again
+type cachedWeight struct {
+	weight  int
+	expires time.Time
+}
+
+// Weigher works out how many times a vote counts from the voter's roles on the server in GuildID,
+// using the multipliers in Discord.RoleWeights
+type Weigher struct {
+	client  Client
+	guildID string
+	weights map[string]int
+
+	mu    sync.Mutex
+	cache map[string]cachedWeight
+	now   func() time.Time
+}
+
+// NewWeigher creates a Weigher for the roles in Discord.RoleWeights
+func NewWeigher(client Client, conf config.Config) *Weigher {
+	return &Weigher{
+		client:  client,
+		guildID: conf.GuildID,
+		weights: conf.Discord.RoleWeights,
+		cache:   make(map[string]cachedWeight),
+		now:     time.Now,
+	}
+}
+
+// Weight returns how many times a vote from userID counts: the highest weight of their roles.
+// Voters who logged in with a token, members without any of the roles and users who aren't members count once.
+// If the member can't be looked up the error is returned, along with a weight of 1.
+func (w *Weigher) Weight(ctx context.Context, userID string) (int, error) {
+	if len(w.weights) == 0 || !snowflake.MatchString(userID) {
+		return 1, nil
+	}
+
+	w.mu.Lock()
+	cached, ok := w.cache[userID]
+	w.mu.Unlock()
+	if ok && w.now().Before(cached.expires) {
+		return cached.weight, nil
+	}
+
+	weight := 1
+	member, err := w.client.GuildMember(w.guildID, userID, discordgo.WithContext(ctx))
+	var restErr *discordgo.RESTError
+	switch {
+	case errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMember:
+		// Someone who has left the server is just another voter
+	case err != nil:
+		return 1, fmt.Errorf("Unable to look up member %s of guild %s: %v", userID, w.guildID, err)
+	default:
+		for _, role := range member.Roles {
+			weight = max(weight, w.weights[role])
+		}
+	}
+
+	w.mu.Lock()
+	w.cache[userID] = cachedWeight{weight: weight, expires: w.now().Add(weightTTL)}
+	w.mu.Unlock()
+	return weight, nil
+}
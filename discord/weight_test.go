@@ -0,0 +1,64 @@
+package discord
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"Emoji-battle-royale/config"
+)
+
+func TestWeight(t *testing.T) {
+	guild := newTestGuild(t)
+	guild.AddMember("80351110224678912", "585871423394185226")
+	guild.AddMember("80351110224678913", "585871423394185226", "585871423394185227", "585871423394185228")
+	guild.AddMember("80351110224678914", "585871423394185228")
+
+	w := NewWeigher(guild, config.Config{
+		GuildID: testGuild,
+		Discord: config.DiscordConfig{RoleWeights: map[string]int{"585871423394185226": 2, "585871423394185227": 3}},
+	})
+	now := time.Date(2030, 7, 5, 5, 45, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+
+	/* each row takes the form:
+	{voter, expected weight, member lookups so far}
+	*/
+	testData := []struct {
+		user    string
+		weight  int
+		lookups int
+	}{
+		{"80351110224678912", 2, 1},
+		{"80351110224678913", 3, 2},
+		{"80351110224678914", 1, 3},
+		// Not a member of the server
+		{"80351110224678915", 1, 4},
+		// Logged in with a token, so there is nobody to look up
+		{"token-voter", 1, 4},
+		// Remembered from before
+		{"80351110224678912", 2, 4},
+	}
+
+	for i, d := range testData {
+		weight, err := w.Weight(context.Background(), d.user)
+		if err != nil || weight != d.weight {
+			t.Errorf("Test[%d] expected weight %d, got %d %v", i, d.weight, weight, err)
+		}
+		if n := guild.MemberLookups(); n != d.lookups {
+			t.Errorf("Test[%d] expected %d lookups, got %d", i, d.lookups, n)
+		}
+	}
+
+	// Once forgotten, failed lookups count once and aren't remembered
+	now = now.Add(weightTTL)
+	guild.Fail("GuildMember", errors.New("502 Bad Gateway"))
+	if weight, err := w.Weight(context.Background(), "80351110224678912"); err == nil || weight != 1 {
+		t.Errorf("Expected a failed lookup to weigh 1 with an error, got %d %v", weight, err)
+	}
+	guild.Fail("GuildMember", nil)
+	if weight, err := w.Weight(context.Background(), "80351110224678912"); err != nil || weight != 2 {
+		t.Errorf("Expected the weight to be looked up again, got %d %v", weight, err)
+	}
+}
@@ -0,0 +1,126 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Checker answers liveness and readiness probes from process supervisors and load balancers
+type Checker struct {
+	mu          sync.Mutex
+	started     time.Time
+	checks      []check
+	maintenance map[string]int
+}
+
+type check struct {
+	name string
+	fn   func() error
+}
+
+// Report is the JSON body returned by both probes
+type Report struct {
+	Status      string            `json:"status"`
+	Uptime      string            `json:"uptime"`
+	Checks      map[string]string `json:"checks,omitempty"`
+	Maintenance []string          `json:"maintenance,omitempty"`
+}
+
+// New creates a Checker with no checks
+func New() *Checker {
+	return &Checker{
+		started:     time.Now(),
+		maintenance: make(map[string]int),
+	}
+}
+
+// Add registers a readiness check. fn returns nil when that part of the server is ready.
+func (c *Checker) Add(name string, fn func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// BeginMaintenance marks the server not ready until the returned function is called.
+// Use it around anything which leaves the database in an in-between state, such as a restore or migration.
+func (c *Checker) BeginMaintenance(reason string) (end func()) {
+	c.mu.Lock()
+	c.maintenance[reason]++
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.maintenance[reason]--; c.maintenance[reason] <= 0 {
+				delete(c.maintenance, reason)
+			}
+		})
+	}
+}
+
+// Ready runs every check and reports whether the server can take traffic
+func (c *Checker) Ready() (bool, Report) {
+	c.mu.Lock()
+	checks := append([]check(nil), c.checks...)
+	var maintenance []string
+	for reason := range c.maintenance {
+		maintenance = append(maintenance, reason)
+	}
+	c.mu.Unlock()
+	sort.Strings(maintenance)
+
+	report := Report{
+		Status:      "ok",
+		Uptime:      time.Since(c.started).Round(time.Second).String(),
+		Checks:      make(map[string]string),
+		Maintenance: maintenance,
+	}
+
+	ready := len(maintenance) == 0
+	for _, ch := range checks {
+		if err := ch.fn(); err != nil {
+			report.Checks[ch.name] = err.Error()
+			ready = false
+		} else {
+			report.Checks[ch.name] = "ok"
+		}
+	}
+	if !ready {
+		report.Status = "unavailable"
+	}
+	return ready, report
+}
+
+func writeReport(w http.ResponseWriter, status int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// LiveHandler serves /healthz. It only says the process is up and able to answer.
+func (c *Checker) LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, Report{
+			Status: "ok",
+			Uptime: time.Since(c.started).Round(time.Second).String(),
+		})
+	})
+}
+
+// ReadyHandler serves /readyz, returning 503 if any check fails or maintenance is in progress
+func (c *Checker) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ready, report := c.Ready()
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeReport(w, status, report)
+	})
+}
@@ -0,0 +1,61 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getReport(t *testing.T, h http.Handler) (int, Report) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("Couldn't decode report: %v", err)
+	}
+	return rec.Code, report
+}
+
+func TestReady(t *testing.T) {
+	c := New()
+	var dbErr error
+	c.Add("database", func() error { return dbErr })
+	c.Add("templates", func() error { return nil })
+
+	if code, report := getReport(t, c.ReadyHandler()); code != http.StatusOK || report.Checks["database"] != "ok" {
+		t.Errorf("Expected ready, got %d %+v", code, report)
+	}
+
+	dbErr = errors.New("VOTES bucket not found")
+	code, report := getReport(t, c.ReadyHandler())
+	if code != http.StatusServiceUnavailable || report.Checks["database"] != "VOTES bucket not found" {
+		t.Errorf("Expected failing database check, got %d %+v", code, report)
+	}
+	if report.Checks["templates"] != "ok" {
+		t.Errorf("Expected the other checks to still be reported, got %+v", report)
+	}
+
+	// The process is still alive even though it isn't ready
+	if code, _ := getReport(t, c.LiveHandler()); code != http.StatusOK {
+		t.Errorf("Expected /healthz to return 200, got %d", code)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	c := New()
+
+	end := c.BeginMaintenance("restore")
+	code, report := getReport(t, c.ReadyHandler())
+	if code != http.StatusServiceUnavailable || len(report.Maintenance) != 1 || report.Maintenance[0] != "restore" {
+		t.Errorf("Expected not ready during restore, got %d %+v", code, report)
+	}
+
+	end()
+	end() // calling it twice mustn't end someone else's maintenance
+	if code, _ := getReport(t, c.ReadyHandler()); code != http.StatusOK {
+		t.Errorf("Expected ready after restore, got %d", code)
+	}
+}
@@ -0,0 +1,258 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Each locale is a flat JSON file of message key => text in locales/.
+Messages can contain named placeholders like {name}, which are filled in by T.
+Keys starting with "format." aren't messages but tell us how to format
+things for that locale, e.g. "format.datetime" is a Go time layout.
+
+Anything missing from a catalog falls back to the default locale.
+*/
+
+//go:embed locales/*.json
+var catalogFiles embed.FS
+
+// DefaultLocale is used when nothing the visitor asks for is available
+const DefaultLocale = "en"
+
+// CookieName is the cookie which remembers a visitor's chosen language
+const CookieName = "ebr_lang"
+
+// Bundle holds every locale
+type Bundle struct {
+	locales map[string]*Locale
+}
+
+// Locale translates and formats for a single language
+type Locale struct {
+	Tag      string
+	messages map[string]string
+	fallback *Locale
+}
+
+// Load reads every catalog built into the binary
+func Load() (*Bundle, error) {
+	files, err := catalogFiles.ReadDir("locales")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{locales: make(map[string]*Locale)}
+	for _, f := range files {
+		data, err := catalogFiles.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		l := &Locale{Tag: strings.TrimSuffix(f.Name(), ".json")}
+		if err := json.Unmarshal(data, &l.messages); err != nil {
+			return nil, fmt.Errorf("Unable to parse catalog %s: %v", f.Name(), err)
+		}
+		b.locales[l.Tag] = l
+	}
+
+	def, ok := b.locales[DefaultLocale]
+	if !ok {
+		return nil, fmt.Errorf("No catalog for the default locale %s", DefaultLocale)
+	}
+	for tag, l := range b.locales {
+		if tag != DefaultLocale {
+			l.fallback = def
+		}
+	}
+	return b, nil
+}
+
+// Language is an available locale and its name in that language, for a language picker
+type Language struct {
+	Tag  string
+	Name string
+}
+
+// Languages returns every available locale ordered by tag
+func (b *Bundle) Languages() []Language {
+	var langs []Language
+	for tag, l := range b.locales {
+		langs = append(langs, Language{Tag: tag, Name: l.T("language.name")})
+	}
+	sort.Slice(langs, func(i, j int) bool { return langs[i].Tag < langs[j].Tag })
+	return langs
+}
+
+// Get returns the locale for tag, or the default locale if there isn't one
+func (b *Bundle) Get(tag string) *Locale {
+	if l, ok := b.locales[tag]; ok {
+		return l
+	}
+	return b.locales[DefaultLocale]
+}
+
+// match returns the available locale for a language tag like "fr-CA", trying "fr" if needed
+func (b *Bundle) match(tag string) (*Locale, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if l, ok := b.locales[tag]; ok {
+		return l, true
+	}
+	if i := strings.IndexAny(tag, "-_"); i > 0 {
+		l, ok := b.locales[tag[:i]]
+		return l, ok
+	}
+	return nil, false
+}
+
+// FromRequest picks the locale for a request.
+// A language chosen with the cookie wins, then the Accept-Language header in order of preference.
+func (b *Bundle) FromRequest(r *http.Request) *Locale {
+	if c, err := r.Cookie(CookieName); err == nil {
+		if l, ok := b.match(c.Value); ok {
+			return l
+		}
+	}
+
+	for _, tag := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if l, ok := b.match(tag); ok {
+			return l
+		}
+	}
+	return b.locales[DefaultLocale]
+}
+
+// parseAcceptLanguage returns the languages in an Accept-Language header, most preferred first
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var langs []weighted
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		if fields[0] == "" || fields[0] == "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v := strings.TrimPrefix(strings.TrimSpace(f), "q="); v != f {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, weighted{tag: fields[0], q: q})
+		}
+	}
+
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// lookup finds key in this locale or its fallback
+func (l *Locale) lookup(key string) (string, bool) {
+	if msg, ok := l.messages[key]; ok {
+		return msg, true
+	}
+	if l.fallback != nil {
+		return l.fallback.lookup(key)
+	}
+	return "", false
+}
+
+// T translates key, filling in placeholders from name, value pairs.
+// Unknown keys are returned as they are so they're easy to spot on the page.
+func (l *Locale) T(key string, pairs ...interface{}) string {
+	msg, ok := l.lookup(key)
+	if !ok {
+		return key
+	}
+
+	for i := 0; i+1 < len(pairs); i += 2 {
+		msg = strings.ReplaceAll(msg, "{"+fmt.Sprint(pairs[i])+"}", fmt.Sprint(pairs[i+1]))
+	}
+	return msg
+}
+
+// Messages returns every message whose key starts with one of prefixes, for passing to JavaScript on the page
+func (l *Locale) Messages(prefixes ...string) map[string]string {
+	m := make(map[string]string)
+	for loc := l; loc != nil; loc = loc.fallback {
+		for key, msg := range loc.messages {
+			if _, done := m[key]; done {
+				continue
+			}
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(key, prefix) {
+					m[key] = msg
+					break
+				}
+			}
+		}
+	}
+	return m
+}
+
+// FormatTime formats t in the locale's date and time layout
+func (l *Locale) FormatTime(t time.Time) string {
+	layout, ok := l.lookup("format.datetime")
+	if !ok {
+		layout = time.RFC1123
+	}
+	return t.Format(layout)
+}
+
+// FormatDuration formats a countdown such as "2d 3h 4m 5s" in the locale's style
+func (l *Locale) FormatDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	d = d.Round(time.Second)
+	days := int(d / (24 * time.Hour))
+	hours := int(d/time.Hour) % 24
+	minutes := int(d/time.Minute) % 60
+	seconds := int(d/time.Second) % 60
+
+	key := "format.countdown"
+	if days > 0 {
+		key = "format.countdown_days"
+	}
+	return l.T(key, "d", days, "h", hours, "m", minutes, "s", seconds)
+}
+
+// SetHandler remembers the language in the "lang" query parameter and sends the visitor back where they came from
+func (b *Bundle) SetHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l, ok := b.match(r.URL.Query().Get("lang")); ok {
+			http.SetCookie(w, &http.Cookie{
+				Name:     CookieName,
+				Value:    l.Tag,
+				Path:     "/",
+				MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		// Only redirect within this site
+		back := "/"
+		if ref := r.URL.Query().Get("back"); strings.HasPrefix(ref, "/") && !strings.HasPrefix(ref, "//") {
+			back = ref
+		}
+		http.Redirect(w, r, back, http.StatusFound)
+	})
+}
@@ -0,0 +1,119 @@
+package i18n
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFromRequest(t *testing.T) {
+	b, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* each row takes the form:
+	{cookie, Accept-Language header, expected locale}
+	*/
+	testData := [][]string{
+		{"", "", "en"},
+		{"", "fr", "fr"},
+		{"", "fr-CA,fr;q=0.9,en;q=0.8", "fr"},
+		{"", "de, es;q=0.5, en;q=0.7", "en"},
+		{"", "de, es;q=0.5", "es"},
+		{"", "es;q=0, fr;q=0.1", "fr"},
+		{"es", "fr", "es"},
+		{"klingon", "fr", "fr"},
+		{"", "*", "en"},
+	}
+
+	for i, d := range testData {
+		r := httptest.NewRequest("GET", "/vote", nil)
+		if d[0] != "" {
+			r.AddCookie(&http.Cookie{Name: CookieName, Value: d[0]})
+		}
+		r.Header.Set("Accept-Language", d[1])
+
+		if got := b.FromRequest(r).Tag; got != d[2] {
+			t.Errorf("Test[%d] expected %s, got %s", i, d[2], got)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	b, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	en, fr := b.Get("en"), b.Get("fr")
+
+	if got := fr.T("after.winner", "name", "jeb"); got != "Le gagnant est jeb !" {
+		t.Errorf("Unexpected translation: %s", got)
+	}
+	if got := en.T("no.such.key"); got != "no.such.key" {
+		t.Errorf("Expected unknown keys to be returned as they are, got %s", got)
+	}
+	if b.Get("klingon") != en {
+		t.Errorf("Expected unknown locales to fall back to %s", DefaultLocale)
+	}
+
+	// Every locale must translate everything the default locale does
+	for _, lang := range b.Languages() {
+		l := b.Get(lang.Tag)
+		for key := range en.messages {
+			if _, ok := l.messages[key]; !ok {
+				t.Errorf("%s is missing %s", lang.Tag, key)
+			}
+		}
+	}
+
+	d := 26*time.Hour + 3*time.Minute + 4*time.Second
+	if got := en.FormatDuration(d); got != "1d 2h 3m 4s" {
+		t.Errorf("Unexpected countdown: %s", got)
+	}
+	if got := fr.FormatDuration(d - 24*time.Hour); got != "2 h 3 min 4 s" {
+		t.Errorf("Unexpected countdown: %s", got)
+	}
+
+	when := time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC)
+	if got := fr.FormatTime(when); got != "05/03/2024 14:30 UTC" {
+		t.Errorf("Unexpected time: %s", got)
+	}
+	if got := en.FormatTime(when); got != "Mar 5, 2024 2:30 PM UTC" {
+		t.Errorf("Unexpected time: %s", got)
+	}
+}
+
+func TestSetHandler(t *testing.T) {
+	b, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* each row takes the form:
+	{query, expected cookie value, expected redirect}
+	*/
+	testData := [][]string{
+		{"lang=fr&back=/vote", "fr", "/vote"},
+		{"lang=es-MX", "es", "/"},
+		{"lang=xx&back=/vote", "", "/vote"},
+		{"lang=fr&back=//evil.example", "fr", "/"},
+	}
+
+	for i, d := range testData {
+		w := httptest.NewRecorder()
+		b.SetHandler().ServeHTTP(w, httptest.NewRequest("GET", "/lang?"+d[0], nil))
+
+		cookie := ""
+		for _, c := range w.Result().Cookies() {
+			if c.Name == CookieName {
+				cookie = c.Value
+			}
+		}
+		if cookie != d[1] || w.Header().Get("Location") != d[2] {
+			t.Errorf("Test[%d] expected cookie %q and redirect %s, got %q and %s", i, d[1], d[2], cookie, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"testing"
+)
+
+func TestFromContext(t *testing.T) {
+	var buf bytes.Buffer
+	Setup(&buf)
+
+	ctx := WithRequestID(context.Background(), "abc123")
+	FromContext(ctx).Info("vote rejected", "candidate", "jeb")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Log line is not JSON: %s", buf.String())
+	}
+	if line["request_id"] != "abc123" || line["candidate"] != "jeb" || line["msg"] != "vote rejected" {
+		t.Errorf("Unexpected log line: %s", buf.String())
+	}
+
+	// The standard logger goes through the same handler
+	buf.Reset()
+	log.Print("plain old log")
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil || line["msg"] != "plain old log" {
+		t.Errorf("Standard log output is not JSON: %s", buf.String())
+	}
+
+	if RequestID(context.Background()) != "" {
+		t.Errorf("Expected no request ID on an empty context")
+	}
+}
@@ -0,0 +1,213 @@
+package manifest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"Emoji-battle-royale/database"
+
+	"github.com/BurntSushi/toml"
+)
+
+/* A manifest lists the candidates for a battle. It can be TOML:
+
+	[[Candidate]]
+	ID = "1234"
+	Name = ":partyparrot:"
+	Image = "emoji/1234.gif"
+	Tags = ["animated"]
+
+JSON, as a list of the same objects, or CSV with a header row naming the columns:
+
+	ID,Name,Image,Tags
+	1234,:partyparrot:,emoji/1234.gif,animated
+
+Only ID is required. CSV tags are separated by spaces.
+*/
+
+// Entry is one candidate in a manifest
+type Entry struct {
+	ID    string
+	Name  string
+	Image string
+	Tags  []string
+
+	// where is where the entry is in the file, for error messages
+	where string
+}
+
+// Error lists everything wrong with a manifest
+type Error struct {
+	File     string
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Invalid candidate manifest %s:\n  %s", e.File, strings.Join(e.Problems, "\n  "))
+}
+
+// imageTypes are the images the web server will serve
+var imageTypes = map[string]bool{".png": true, ".gif": true, ".jpg": true, ".jpeg": true, ".webp": true}
+
+// Load reads the manifest in filename, working out the format from its extension.
+// Every image must exist in imageDir. If anything is wrong an *Error listing all of it is returned.
+func Load(filename string, imageDir string) ([]database.Candidate, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".toml":
+		entries, err = readTOML(f)
+	case ".json":
+		entries, err = readJSON(f)
+	case ".csv":
+		entries, err = readCSV(f)
+	default:
+		err = fmt.Errorf("unknown format %q, expected .toml, .json or .csv", ext)
+	}
+	if err != nil {
+		return nil, &Error{File: filename, Problems: []string{err.Error()}}
+	}
+
+	if problems := check(entries, imageDir); len(problems) > 0 {
+		return nil, &Error{File: filename, Problems: problems}
+	}
+
+	candidates := make([]database.Candidate, len(entries))
+	for i, e := range entries {
+		candidates[i] = database.Candidate{
+			ID:            e.ID,
+			CandidateInfo: database.CandidateInfo{Name: e.Name, Image: e.Image, Tags: e.Tags},
+			Active:        true,
+		}
+	}
+	return candidates, nil
+}
+
+func readTOML(r io.Reader) ([]Entry, error) {
+	var m struct {
+		Candidate []Entry
+	}
+	md, err := toml.NewDecoder(r).Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown key %s", undecoded[0])
+	}
+	for i := range m.Candidate {
+		m.Candidate[i].where = fmt.Sprintf("candidate %d", i+1)
+	}
+	return m.Candidate, nil
+}
+
+func readJSON(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entries); err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].where = fmt.Sprintf("candidate %d", i+1)
+	}
+	return entries, nil
+}
+
+func readCSV(r io.Reader) ([]Entry, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header row: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "id", "name", "image", "tags":
+			columns[name] = i
+		default:
+			return nil, fmt.Errorf("unknown column %q, expected ID, Name, Image and Tags", header[i])
+		}
+	}
+	if _, ok := columns["id"]; !ok {
+		return nil, errors.New("there is no ID column")
+	}
+
+	var entries []Entry
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		get := func(column string) string {
+			if i, ok := columns[column]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		line, _ := cr.FieldPos(0)
+		entries = append(entries, Entry{
+			ID:    get("id"),
+			Name:  get("name"),
+			Image: get("image"),
+			Tags:  strings.Fields(get("tags")),
+			where: fmt.Sprintf("line %d", line),
+		})
+	}
+	return entries, nil
+}
+
+// check returns every problem with the entries
+func check(entries []Entry, imageDir string) []string {
+	var problems []string
+	if len(entries) < 2 {
+		problems = append(problems, fmt.Sprintf("a battle needs at least 2 candidates, found %d", len(entries)))
+	}
+
+	seen := make(map[string]string)
+	for _, e := range entries {
+		if e.ID == "" {
+			problems = append(problems, e.where+": ID is missing")
+			continue
+		}
+		if first, ok := seen[e.ID]; ok {
+			problems = append(problems, fmt.Sprintf("%s: %s is a duplicate of %s", e.where, e.ID, first))
+		} else {
+			seen[e.ID] = e.where
+		}
+
+		if e.Image == "" {
+			continue
+		}
+		if path.IsAbs(e.Image) || path.Clean(e.Image) != e.Image || strings.HasPrefix(e.Image, "../") {
+			problems = append(problems, fmt.Sprintf("%s: image %s must be a path inside the image directory", e.where, e.Image))
+			continue
+		}
+		if !imageTypes[strings.ToLower(path.Ext(e.Image))] {
+			problems = append(problems, fmt.Sprintf("%s: image %s must be a png, gif, jpg or webp", e.where, e.Image))
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(imageDir, filepath.FromSlash(e.Image))); err != nil || info.IsDir() {
+			problems = append(problems, fmt.Sprintf("%s: image %s not found in %s", e.where, e.Image, imageDir))
+		}
+	}
+	return problems
+}
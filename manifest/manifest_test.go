@@ -0,0 +1,100 @@
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	images := t.TempDir()
+	os.MkdirAll(filepath.Join(images, "battle"), 0755)
+	os.WriteFile(filepath.Join(images, "battle", "1.gif"), []byte("GIF89a"), 0644)
+	os.WriteFile(filepath.Join(images, "battle", "2.png"), []byte("png"), 0644)
+
+	/* each row takes the form:
+	{file name, contents}
+	All of them describe the same two candidates.
+	*/
+	testData := [][]string{
+		{"candidates.toml", `
+[[Candidate]]
+ID = "1"
+Name = ":parrot:"
+Image = "battle/1.gif"
+Tags = ["animated", "custom"]
+
+[[Candidate]]
+ID = "jeb"
+`},
+		{"candidates.json", `[
+  {"ID": "1", "Name": ":parrot:", "Image": "battle/1.gif", "Tags": ["animated", "custom"]},
+  {"ID": "jeb"}
+]`},
+		{"candidates.csv", "id, name, image, tags\n1,:parrot:,battle/1.gif,animated custom\njeb,,,\n"},
+	}
+
+	for i, d := range testData {
+		filename := filepath.Join(t.TempDir(), d[0])
+		os.WriteFile(filename, []byte(d[1]), 0644)
+
+		candidates, err := Load(filename, images)
+		if err != nil {
+			t.Errorf("Test[%d] couldn't load %s: %v", i, d[0], err)
+			continue
+		}
+		if len(candidates) != 2 || candidates[0].ID != "1" || candidates[0].Name != ":parrot:" ||
+			candidates[0].Image != "battle/1.gif" || strings.Join(candidates[0].Tags, ",") != "animated,custom" ||
+			candidates[1].ID != "jeb" || candidates[1].DisplayName() != "jeb" || !candidates[1].Active {
+			t.Errorf("Test[%d] unexpected candidates from %s: %+v", i, d[0], candidates)
+		}
+	}
+}
+
+func TestLoadProblems(t *testing.T) {
+	images := t.TempDir()
+	os.WriteFile(filepath.Join(images, "1.gif"), []byte("GIF89a"), 0644)
+
+	contents := strings.Join([]string{
+		"ID,Image",
+		"1,1.gif",
+		"2,missing.png",
+		"1,",
+		",1.gif",
+		"3,../outside.png",
+		"4,notes.txt",
+	}, "\n")
+	filename := filepath.Join(t.TempDir(), "candidates.csv")
+	os.WriteFile(filename, []byte(contents), 0644)
+
+	_, err := Load(filename, images)
+	var me *Error
+	if !errors.As(err, &me) {
+		t.Fatalf("Expected a manifest Error, got %v", err)
+	}
+
+	// Every problem is reported at once
+	expected := []string{
+		"line 3: image missing.png not found",
+		"line 4: 1 is a duplicate of line 2",
+		"line 5: ID is missing",
+		"line 6: image ../outside.png must be a path inside the image directory",
+		"line 7: image notes.txt must be a png, gif, jpg or webp",
+	}
+	if len(me.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v", len(expected), me.Problems)
+	}
+	for i, p := range me.Problems {
+		if !strings.HasPrefix(p, expected[i]) {
+			t.Errorf("Test[%d] expected %q, got %q", i, expected[i], p)
+		}
+	}
+
+	filename = filepath.Join(t.TempDir(), "candidates.yaml")
+	os.WriteFile(filename, []byte("- jeb"), 0644)
+	if _, err := Load(filename, images); err == nil {
+		t.Errorf("Expected an unknown format to be an error")
+	}
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ebr"
+
+// Metrics holds everything exported on /metrics
+type Metrics struct {
+	registry        *prometheus.Registry
+	votesAccepted   prometheus.Counter
+	votesRejected   *prometheus.CounterVec
+	dbDuration      *prometheus.HistogramVec
+	httpRequests    *prometheus.CounterVec
+	httpDuration    *prometheus.HistogramVec
+	schedulerEvents *prometheus.CounterVec
+}
+
+// Sources are read every time the metrics are scraped, so they're always current
+type Sources struct {
+	Votes func() map[string]int
+	Phase func() int
+	Round func() int
+}
+
+// candidateCollector reports the vote total of every candidate
+type candidateCollector struct {
+	desc  *prometheus.Desc
+	votes func() map[string]int
+}
+
+func (c candidateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c candidateCollector) Collect(ch chan<- prometheus.Metric) {
+	for candidate, total := range c.votes() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(total), candidate)
+	}
+}
+
+// New creates and registers all metrics
+func New(src Sources) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		votesAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "votes_accepted_total",
+			Help:      "Vote transactions stored in the database.",
+		}),
+		votesRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "votes_rejected_total",
+			Help:      "Vote transactions turned away, by reason.",
+		}, []string{"reason"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_transaction_duration_seconds",
+			Help:      "Time spent in bolt transactions, by Store method.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"op"}),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency, by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		schedulerEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scheduler_events_total",
+			Help:      "Events sent by the scheduler, by type.",
+		}, []string{"event"}),
+	}
+
+	m.registry.MustRegister(
+		m.votesAccepted,
+		m.votesRejected,
+		m.dbDuration,
+		m.httpRequests,
+		m.httpDuration,
+		m.schedulerEvents,
+		candidateCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(namespace, "", "candidate_votes"),
+				"Current vote total of each candidate.",
+				[]string{"candidate"}, nil,
+			),
+			votes: src.Votes,
+		},
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "phase",
+			Help:      "Current phase of the battle: 0 before, 1 during, 2 after.",
+		}, func() float64 { return float64(src.Phase()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "round",
+			Help:      "Number of eliminations which have taken place.",
+		}, func() float64 { return float64(src.Round()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// VoteAccepted counts a stored vote transaction
+func (m *Metrics) VoteAccepted() {
+	m.votesAccepted.Inc()
+}
+
+// VoteRejected counts a vote transaction which was turned away
+func (m *Metrics) VoteRejected(reason string) {
+	m.votesRejected.WithLabelValues(reason).Inc()
+}
+
+// ObserveDB records how long a database transaction took
+func (m *Metrics) ObserveDB(op string, d time.Duration) {
+	m.dbDuration.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// ObserveRequest records a finished HTTP request
+func (m *Metrics) ObserveRequest(route string, method string, code int, d time.Duration) {
+	m.httpRequests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	m.httpDuration.WithLabelValues(route, method).Observe(d.Seconds())
+}
+
+// SchedulerEvent counts an event sent by the scheduler
+func (m *Metrics) SchedulerEvent(event string) {
+	m.schedulerEvents.WithLabelValues(event).Inc()
+}
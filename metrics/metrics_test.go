@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	m := New(Sources{
+		Votes: func() map[string]int { return map[string]int{"ted": 7, "jeb": 85} },
+		Phase: func() int { return 1 },
+		Round: func() int { return 2 },
+	})
+
+	m.VoteAccepted()
+	m.VoteAccepted()
+	m.VoteRejected("eliminated_candidate")
+	m.ObserveDB("SubmitTransaction", 3*time.Millisecond)
+	m.ObserveRequest("/vote", "POST", 200, 20*time.Millisecond)
+	m.SchedulerEvent("start")
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	expected := []string{
+		"ebr_votes_accepted_total 2",
+		`ebr_votes_rejected_total{reason="eliminated_candidate"} 1`,
+		`ebr_candidate_votes{candidate="jeb"} 85`,
+		`ebr_candidate_votes{candidate="ted"} 7`,
+		"ebr_phase 1",
+		"ebr_round 2",
+		`ebr_db_transaction_duration_seconds_count{op="SubmitTransaction"} 1`,
+		`ebr_http_requests_total{code="200",method="POST",route="/vote"} 1`,
+		`ebr_http_request_duration_seconds_count{method="POST",route="/vote"} 1`,
+		`ebr_scheduler_events_total{event="start"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e+"\n") {
+			t.Errorf("Expected metrics to contain %q", e)
+		}
+	}
+}
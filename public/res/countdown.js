@@ -0,0 +1,53 @@
+/* Shared by the vote pages. `messages` and `lang` are set by the page template.
+
+<time class="local" datetime="..."> is rewritten in the visitor's own time zone,
+and <span class="countdown" data-until="..."> counts down to that time.
+Countdowns with data-reload reload the page once they reach zero.
+*/
+
+function translate(key, values) {
+  var msg = messages[key] || key;
+  for (var name in values) {
+    msg = msg.split("{" + name + "}").join(values[name]);
+  }
+  return msg;
+}
+
+function formatCountdown(ms) {
+  var total = Math.max(0, Math.floor(ms / 1000));
+  var values = {
+    d: Math.floor(total / 86400),
+    h: Math.floor(total / 3600) % 24,
+    m: Math.floor(total / 60) % 60,
+    s: total % 60
+  };
+  return translate(values.d > 0 ? "format.countdown_days" : "format.countdown", values);
+}
+
+function updateCountdowns() {
+  var reload = false;
+  document.querySelectorAll(".countdown").forEach(function (el) {
+    var left = new Date(el.dataset.until) - new Date();
+    el.textContent = formatCountdown(left);
+    if (left <= 0 && el.dataset.reload && !el.dataset.done) {
+      el.dataset.done = "true";
+      reload = true;
+    }
+  });
+  // The page changes when the phase does
+  if (reload) {
+    setTimeout(function () { location.reload(); }, 1000);
+  }
+}
+
+document.addEventListener("DOMContentLoaded", function () {
+  document.querySelectorAll("time.local").forEach(function (el) {
+    el.textContent = new Date(el.getAttribute("datetime")).toLocaleString(lang, {
+      dateStyle: "medium",
+      timeStyle: "short"
+    });
+  });
+
+  updateCountdowns();
+  setInterval(updateCountdowns, 1000);
+});
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Now()
+	l := New(2, 3)
+	l.now = func() time.Time { return now }
+
+	// The full burst is allowed straight away
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("jonny"); !ok {
+			t.Errorf("Request %d of burst was throttled", i)
+		}
+	}
+
+	ok, wait := l.Allow("jonny")
+	if ok {
+		t.Errorf("Request over burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %v", wait)
+	}
+
+	// Other keys have their own bucket
+	if ok, _ := l.Allow("billy"); !ok {
+		t.Errorf("billy was throttled because of jonny")
+	}
+
+	now = now.Add(wait)
+	if ok, _ := l.Allow("jonny"); !ok {
+		t.Errorf("Request after waiting was throttled")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+	l := New(1, 5)
+	l.now = func() time.Time { return now }
+
+	l.Allow("jonny")
+	l.Allow("billy")
+	if l.Len() != 2 {
+		t.Errorf("Expected 2 buckets, got %d", l.Len())
+	}
+
+	now = now.Add(2 * sweepInterval)
+	l.Allow("ted")
+	if l.Len() != 1 {
+		t.Errorf("Expected idle buckets to be swept, %d remain", l.Len())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"Emoji-battle-royale/clientip"
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/ratelimit"
+	"Emoji-battle-royale/scheduler"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// liveSettings are the parts of the server which follow the config while it runs.
+// They are replaced as a whole when the config is reloaded, never changed in place.
+type liveSettings struct {
+	conf      config.Config
+	sched     scheduler.Schedule
+	voters    *ratelimit.Limiter
+	ips       *ratelimit.Limiter
+	clientIPs *clientip.Resolver
+}
+
+var live atomic.Pointer[liveSettings]
+
+// current returns the settings in use right now
+func current() *liveSettings {
+	return live.Load()
+}
+
+// newLiveSettings builds the settings for conf. Limiters whose limits haven't changed
+// are kept from previous, which may be nil, so voters don't get a fresh burst on every reload.
+func newLiveSettings(conf config.Config, rounds int, previous *liveSettings) (*liveSettings, error) {
+	resolver, err := clientip.New(conf.Server.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &liveSettings{
+		conf:      conf,
+		sched:     scheduler.CreateSchedule(conf.StartTime, conf.EndTime, rounds),
+		voters:    newLimiter(conf.RateLimit.VoterRate, conf.RateLimit.VoterBurst),
+		ips:       newLimiter(conf.RateLimit.IPRate, conf.RateLimit.IPBurst),
+		clientIPs: resolver,
+	}
+
+	if previous != nil {
+		old := previous.conf.RateLimit
+		if old.VoterRate == conf.RateLimit.VoterRate && old.VoterBurst == conf.RateLimit.VoterBurst {
+			s.voters = previous.voters
+		}
+		if old.IPRate == conf.RateLimit.IPRate && old.IPBurst == conf.RateLimit.IPBurst {
+			s.ips = previous.ips
+		}
+	}
+	return s, nil
+}
+
+// reloadConfig reads the config again and applies whatever can be changed without a restart.
+// If the new config is invalid nothing changes. It returns true if the schedule changed.
+func reloadConfig(rounds int) bool {
+	next, err := loadConfig()
+	if err != nil {
+		var ve *config.ValidationError
+		if errors.As(err, &ve) {
+			var problems []string
+			for _, p := range ve.Problems {
+				problems = append(problems, p.String())
+			}
+			slog.Error("Config reload rejected, keeping the current config", "file", ve.File, "problems", problems)
+		} else {
+			slog.Error("Config reload rejected, keeping the current config", "error", err)
+		}
+		return false
+	}
+
+	previous := current()
+	conf, applied, needRestart := config.Reload(previous.conf, next)
+
+	if len(needRestart) > 0 {
+		slog.Warn("Config changes need a restart to take effect", "fields", needRestart)
+	}
+	if len(applied) == 0 {
+		slog.Info("Config reloaded, nothing to apply")
+		return false
+	}
+
+	s, err := newLiveSettings(conf, rounds, previous)
+	if err != nil {
+		slog.Error("Config reload rejected, keeping the current config", "error", err)
+		return false
+	}
+	live.Store(s)
+	slog.Info("Config reloaded", "fields", applied)
+
+	return !conf.StartTime.Equal(previous.conf.StartTime) || !conf.EndTime.Equal(previous.conf.EndTime)
+}
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// watchConfig calls reload on SIGHUP and whenever filename changes, until ctx is cancelled
+func watchConfig(ctx context.Context, filename string, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	last := fileVersion(filename)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Reloading config", "reason", "SIGHUP")
+			last = fileVersion(filename)
+			reload()
+		case <-ticker.C:
+			if v := fileVersion(filename); v != last {
+				last = v
+				slog.Info("Reloading config", "reason", "file changed")
+				reload()
+			}
+		}
+	}
+}
+
+// fileVersion changes whenever the file is written, or disappears
+func fileVersion(filename string) string {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%v %d", info.ModTime(), info.Size())
+}
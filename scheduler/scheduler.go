@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"context"
 	"time"
 )
 
@@ -30,8 +31,24 @@ const (
 	After
 ) // Golang Enum notation is weird
 
-// CreateSchedule makes a new schedule
+func (p Phase) String() string {
+	switch p {
+	case Before:
+		return "before"
+	case During:
+		return "during"
+	case After:
+		return "after"
+	}
+	return "unknown"
+}
+
+// CreateSchedule makes a new schedule.
+// There is always at least one elimination, at the end, since the period between them is divided by elim.
 func CreateSchedule(start time.Time, end time.Time, elim int) Schedule {
+	if elim < 1 {
+		elim = 1
+	}
 	return Schedule{
 		startTime:            start,
 		endTime:              end,
@@ -51,6 +68,33 @@ func (sch Schedule) GetPhase() Phase {
 	return After
 }
 
+// GetRound returns how many eliminations have taken place so far
+func (sch Schedule) GetRound() int {
+	return sch.getEliminations()
+}
+
+// GetTotalRounds returns how many eliminations there will be altogether
+func (sch Schedule) GetTotalRounds() int {
+	return sch.numberOfEliminations
+}
+
+// NextChange returns the time of the next start, elimination or end.
+// Once the battle is over it returns the end time.
+func (sch Schedule) NextChange() time.Time {
+	switch sch.GetPhase() {
+	case Before:
+		return sch.startTime
+	case During:
+		eliminationPeriod := sch.endTime.Sub(sch.startTime) / time.Duration(sch.numberOfEliminations)
+		next := sch.startTime.Add(time.Duration(sch.getEliminations()+1) * eliminationPeriod)
+		if next.After(sch.endTime) {
+			return sch.endTime
+		}
+		return next
+	}
+	return sch.endTime
+}
+
 func (sch Schedule) getEliminations() int {
 	now := time.Now()
 
@@ -101,3 +145,46 @@ func (sch Schedule) TriggerChangeOccurs(c chan bool) {
 		tic += eliminationPeriod
 	}
 }
+
+// Subscribe works like TriggerChangeOccurs but can be stopped.
+/* The returned channel receives the same true/false events. It is closed after the
+final false is sent, or as soon as ctx is cancelled, so a consumer can simply range over it.
+*/
+func (sch Schedule) Subscribe(ctx context.Context) <-chan bool {
+	c := make(chan bool)
+
+	go func() {
+		defer close(c)
+
+		eliminationPeriod := sch.endTime.Sub(sch.startTime) / time.Duration(sch.numberOfEliminations)
+
+		for i := 0; i <= sch.numberOfEliminations; i++ {
+			last := i == sch.numberOfEliminations
+			tic := time.Until(sch.startTime.Add(time.Duration(i) * eliminationPeriod))
+			if last {
+				tic = time.Until(sch.endTime)
+			}
+
+			// Events which have already passed are skipped, except for the final one
+			if tic < 0 && !last {
+				continue
+			}
+
+			timer := time.NewTimer(tic)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case c <- !last:
+			}
+		}
+	}()
+
+	return c
+}
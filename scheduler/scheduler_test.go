@@ -3,6 +3,7 @@ package scheduler
 import (
 	//	"fmt"
 
+	"context"
 	"testing"
 	"time"
 )
@@ -70,6 +71,90 @@ func TestGetEliminations(t *testing.T) {
 	}
 }
 
+func TestNextChange(t *testing.T) {
+	now := time.Now()
+
+	/* each row takes the form:
+	{start hour, end hour, number eliminations, expected hours from start}
+	*/
+	testData := [][]int{
+		{1, 2, 5, 0},
+		{-1, 2, 3, 2},
+		{-2, 1, 1, 3},
+		{-2, -1, 5, 1},
+	}
+
+	for i, d := range testData {
+		sch := Schedule{
+			startTime:            now.Add(time.Duration(d[0]) * time.Hour),
+			endTime:              now.Add(time.Duration(d[1]) * time.Hour),
+			numberOfEliminations: d[2],
+		}
+
+		expected := sch.startTime.Add(time.Duration(d[3]) * time.Hour)
+		if !sch.NextChange().Equal(expected) {
+			t.Errorf("Test[%d] expected %v, got %v", i, expected, sch.NextChange())
+		}
+	}
+}
+
+// collect reads every event from c until it is closed
+func collect(c <-chan bool) []bool {
+	var events []bool
+	for e := range c {
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestSubscribe(t *testing.T) {
+	// Millisecond schedules so the test finishes quickly
+	testData := []struct {
+		start, end time.Duration
+		elim       int
+		expected   []bool
+	}{
+		{10 * time.Millisecond, 70 * time.Millisecond, 3, []bool{true, true, true, false}},
+		{-30 * time.Millisecond, 50 * time.Millisecond, 2, []bool{true, false}},
+		{-2 * time.Hour, -1 * time.Hour, 5, []bool{false}},
+	}
+
+	for i, d := range testData {
+		now := time.Now()
+		sch := CreateSchedule(now.Add(d.start), now.Add(d.end), d.elim)
+
+		events := collect(sch.Subscribe(context.Background()))
+		if len(events) != len(d.expected) {
+			t.Errorf("Test[%d] expected %v, got %v", i, d.expected, events)
+			continue
+		}
+		for j := range events {
+			if events[j] != d.expected[j] {
+				t.Errorf("Test[%d] expected %v, got %v", i, d.expected, events)
+				break
+			}
+		}
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	now := time.Now()
+	sch := CreateSchedule(now.Add(1*time.Hour), now.Add(2*time.Hour), 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := sch.Subscribe(ctx)
+	cancel()
+
+	select {
+	case _, ok := <-c:
+		if ok {
+			t.Errorf("Received an event after cancelling")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Channel was not closed after cancelling")
+	}
+}
+
 /*
 // TestTriggers isn't really a good test because it requires real-time to complete it
 // I'm not sure of a good way to redo the
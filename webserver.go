@@ -1,14 +1,33 @@
 package main
 
 import (
+	"Emoji-battle-royale/auth"
 	"Emoji-battle-royale/config"
 	"Emoji-battle-royale/database"
+	"Emoji-battle-royale/discord"
+	"Emoji-battle-royale/health"
+	"Emoji-battle-royale/i18n"
+	"Emoji-battle-royale/logging"
+	"Emoji-battle-royale/manifest"
+	"Emoji-battle-royale/metrics"
+	"Emoji-battle-royale/ratelimit"
 	"Emoji-battle-royale/scheduler"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"html/template"
+	"io/fs"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	//	"time"
@@ -18,111 +37,856 @@ import (
 	"github.com/gorilla/mux"
 )
 
-// ServeSingleFileHandler returns a handler which serves up a single static file from the public directory
-func ServeSingleFileHandler(filename string) http.Handler {
+// PageHandler returns a handler which renders a page template in the visitor's language
+func PageHandler(tmpl *template.Template) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fileDirectory := "public"
-		//log.Printf("About to serve %s\n", fileDirectory+"/"+filename)
-		http.ServeFile(w, r, fileDirectory+"/"+filename)
+		if err := tmpl.Execute(w, newPageData(r, current().conf)); err != nil {
+			logging.FromContext(r.Context()).Error("Unable to render page", "page", tmpl.Name(), "error", err)
+		}
 	})
 }
 
+// VoteResponse is the JSON body sent back after a vote is accepted
+type VoteResponse struct {
+	TransactionID int            `json:"TransactionID"`
+	Votes         database.Votes `json:"Votes"`
+}
+
+// VoteErrorResponse is the JSON body sent back when a vote is rejected.
+// Error and Reason are translated for the voter, Code is for programs to check.
+type VoteErrorResponse struct {
+	Error     string `json:"Error"`
+	Code      string `json:"Code"`
+	Candidate string `json:"Candidate,omitempty"`
+	Reason    string `json:"Reason,omitempty"`
+	RequestID string `json:"RequestID,omitempty"`
+}
+
+// writeJSON sends v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Unable to write JSON response", "error", err)
+	}
+}
+
+// voteErrorStatus maps an error from the database to the HTTP status it should be reported as,
+// and the reason it is counted under in the metrics
+func voteErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, database.ErrInvalidVoteCount):
+		return http.StatusUnprocessableEntity, "invalid_count"
+	case errors.Is(err, database.ErrUnknownCandidate):
+		return http.StatusUnprocessableEntity, "unknown_candidate"
+	case errors.Is(err, database.ErrCandidateEliminated):
+		return http.StatusConflict, "eliminated_candidate"
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// maxVoteBody is the most POST /vote will read, which is room for a vote for each of
+// the 500 emoji a Discord server can have
+const maxVoteBody = 16 << 10
+
 // VotePOSTHandler This recieves votes as POST requests to /vote and records them to the database
 func VotePOSTHandler(response http.ResponseWriter, request *http.Request) {
+	logger := logging.FromContext(request.Context())
+	requestID := logging.RequestID(request.Context())
+	l := locales.FromRequest(request)
+
+	if !votingOpen() {
+		writeJSON(response, http.StatusForbidden, VoteErrorResponse{
+			Error:     l.T("error.closed"),
+			Code:      "closed",
+			RequestID: requestID,
+		})
+		return
+	}
+
+	userID, err := sessions.UserID(request)
+	if err != nil {
+		stats.VoteRejected("unauthenticated")
+		writeJSON(response, http.StatusUnauthorized, VoteErrorResponse{
+			Error:     l.T("error.unauthenticated"),
+			Code:      "unauthenticated",
+			RequestID: requestID,
+		})
+		return
+	}
 
 	t := database.Transaction{}
-	err := json.NewDecoder(request.Body).Decode(&t)
+	err = json.NewDecoder(http.MaxBytesReader(response, request.Body, maxVoteBody)).Decode(&t)
+	if err != nil {
+		logger.Warn("Unable to parse transaction", "voter", userID, "error", err)
+		stats.VoteRejected("bad_request")
+		writeJSON(response, http.StatusBadRequest, VoteErrorResponse{
+			Error:     l.T("error.bad_request"),
+			Code:      "bad_request",
+			RequestID: requestID,
+		})
+		return
+	}
+	// The voter is whoever the session says they are, not whatever the client sent
+	t.UserID = userID
+	t.IP = clientIP(request)
+	t.RequestID = requestID
+	t.Weight = voteWeight(request.Context(), userID)
+
+	// The rate limit counts requests, so the votes in each one have to be capped too
+	limits := current().conf.RateLimit
+	err = t.CheckLimits(limits.MaxVotesPerCandidate, limits.MaxVotesPerTransaction, len(db.GetCandidateList(true)))
+	var id int
+	if err == nil {
+		id, err = db.SubmitTransaction(t)
+	}
 	if err != nil {
-		fmt.Println("Unable to parse transaction:", request.Body)
-		http.Error(response, "422 unable to parse input", 422)
+		status, reason := voteErrorStatus(err)
+		stats.VoteRejected(reason)
+		body := VoteErrorResponse{Error: l.T("error.rejected"), Code: reason, RequestID: requestID}
+
+		var ce *database.CandidateError
+		if errors.As(err, &ce) {
+			body.Candidate = ce.Candidate
+			body.Reason = l.T("reason." + reason)
+			logger.Info("Vote rejected", "voter", userID, "candidate", ce.Candidate, "reason", reason)
+		} else if status != http.StatusInternalServerError {
+			body.Reason = l.T("reason." + reason)
+			logger.Info("Vote rejected", "voter", userID, "reason", reason, "error", err)
+		} else {
+			// Don't leak internal database errors to the client
+			logger.Error("Unable to store transaction", "voter", userID, "error", err)
+			body.Error = l.T("error.internal")
+		}
+
+		writeJSON(response, status, body)
 		return
 	}
 
-	db.StoreTransaction(t)
+	stats.VoteAccepted()
+	logger.Info("Vote accepted", "voter", userID, "transaction", id, "weight", t.Weight)
+	writeJSON(response, http.StatusOK, VoteResponse{
+		TransactionID: id,
+		Votes:         db.GetVotes(),
+	})
+}
+
+// votingOpen reports whether votes are being taken, which is only between StartTime and EndTime.
+// If not, the vote is counted as rejected. Votes from the site and from Discord both go through it.
+func votingOpen() bool {
+	if current().sched.GetPhase() != scheduler.During {
+		stats.VoteRejected("closed")
+		return false
+	}
+	return true
+}
+
+// discordVote records a vote cast on Discord. It is held to the same rules as VotePOSTHandler,
+// with the Discord user ID as the voter: it must be cast while voting is open, shares the per-voter
+// rate limit and is checked and weighted the same way.
+func discordVote(userID string, candidate string) error {
+	if !votingOpen() {
+		return discord.ErrVotingClosed
+	}
+	settings := current()
+	if settings.voters != nil {
+		if ok, wait := settings.voters.Allow(userID); !ok {
+			stats.VoteRejected("throttled_voter")
+			return &discord.ThrottledError{Wait: wait}
+		}
+	}
+
+	t := database.Transaction{UserID: userID, Votes: database.Votes{candidate: 1}, RequestID: logging.NewRequestID()}
+	t.Weight = voteWeight(logging.WithRequestID(context.Background(), t.RequestID), userID)
+	id, err := db.SubmitTransaction(t)
+	if err != nil {
+		_, reason := voteErrorStatus(err)
+		stats.VoteRejected(reason)
+		slog.Info("Vote rejected", "voter", userID, "candidate", candidate, "reason", reason, "source", "discord", "request_id", t.RequestID)
+		return err
+	}
+
+	stats.VoteAccepted()
+	slog.Info("Vote accepted", "voter", userID, "transaction", id, "weight", t.Weight, "source", "discord", "request_id", t.RequestID)
+	return nil
+}
+
+// weightTimeout limits how long a vote waits for the voter's roles to be looked up
+const weightTimeout = 5 * time.Second
+
+// voteWeight is how many times a vote from userID counts, from their roles on Discord.
+// If the roles can't be looked up the vote still counts once, rather than being turned away.
+func voteWeight(ctx context.Context, userID string) int {
+	if weigher == nil {
+		return 1
+	}
+	ctx, cancel := context.WithTimeout(ctx, weightTimeout)
+	defer cancel()
+
+	weight, err := weigher.Weight(ctx, userID)
+	if err != nil {
+		logging.FromContext(ctx).Warn("Counting the vote once", "voter", userID, "error", err)
+	}
+	return weight
+}
+
+// clientIP returns the IP address the request came from, looking through trusted proxies
+func clientIP(r *http.Request) string {
+	return current().clientIPs.IP(r)
+}
+
+// tooManyRequests sends a 429 telling the client how many seconds to wait
+func tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeJSON(w, http.StatusTooManyRequests, VoteErrorResponse{
+		Error:     locales.FromRequest(r).T("error.too_many_requests"),
+		Code:      "too_many_requests",
+		RequestID: logging.RequestID(r.Context()),
+	})
+}
+
+// RateLimitHandler throttles requests to next, both per client IP and per logged in voter,
+// using the current limiters. A nil limiter turns that check off.
+func RateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := current()
+		voters, ips := settings.voters, settings.ips
+
+		if ips != nil {
+			if ok, wait := ips.Allow(clientIP(r)); !ok {
+				stats.VoteRejected("throttled_ip")
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+
+		if voters != nil {
+			// Requests without a session are rejected by the vote handler anyway
+			if userID, err := sessions.UserID(r); err == nil {
+				if ok, wait := voters.Allow(userID); !ok {
+					stats.VoteRejected("throttled_voter")
+					tooManyRequests(w, r, wait)
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// InstrumentHandler is router middleware which gives each request an ID,
+// records the count and latency of requests by route, and logs every request
+func InstrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		requestID := logging.NewRequestID()
+		w.Header().Set("X-Request-ID", requestID)
+		r = r.WithContext(logging.WithRequestID(r.Context(), requestID))
+
+		next.ServeHTTP(sr, r)
+		latency := time.Since(start)
+
+		// Use the route template so /res/a.png and /res/b.png are counted together
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tmpl, err := cr.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		stats.ObserveRequest(route, r.Method, sr.status, latency)
+
+		voter, _ := sessions.UserID(r)
+		slog.Info("Request",
+			"request_id", requestID,
+			"method", r.Method,
+			"route", route,
+			"path", r.URL.Path,
+			"status", sr.status,
+			"latency_ms", float64(latency.Microseconds())/1000,
+			"voter", voter,
+			"ip", clientIP(r),
+		)
+	})
+}
+
+// instrumentRouter runs InstrumentHandler for every request to r. mux only runs middleware
+// for matched routes, so the 404 and 405 handlers are wrapped as well.
+func instrumentRouter(r *mux.Router) {
+	r.Use(InstrumentHandler)
+	r.NotFoundHandler = InstrumentHandler(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = InstrumentHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+}
+
+// newLimiter creates a limiter from the config, or nil if the limit is turned off
+func newLimiter(rate float64, burst int) *ratelimit.Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return ratelimit.New(rate, burst)
+}
+
+// PageData is shared by every page template
+type PageData struct {
+	L         *i18n.Locale
+	Languages []i18n.Language
+	// Messages are the translations used by the page's JavaScript
+	Messages map[string]string
+	// Back is where the language picker returns to
+	Back         string
+	ElectionName string
+	// DiscordLogin is set when voters log in through /login, which only exists in the discord LoginMode
+	DiscordLogin bool
+}
+
+// newPageData fills in the PageData for a request in the visitor's language
+func newPageData(r *http.Request, conf config.Config) PageData {
+	l := locales.FromRequest(r)
+	return PageData{
+		L:            l,
+		Languages:    locales.Languages(),
+		Messages:     l.Messages("js.", "format.countdown"),
+		Back:         r.URL.Path,
+		ElectionName: conf.ElectionName,
+		DiscordLogin: conf.LoginMode == "discord" || conf.LoginMode == "",
+	}
 }
 
 // VoteGETHandler returns a vote page based on the current phase
-func VoteGETHandler(sched scheduler.Schedule) http.Handler {
+func VoteGETHandler() http.Handler {
+
+	type BeforePageTemplateData struct {
+		PageData
+		StartTime time.Time
+		Remaining time.Duration
+	}
 
 	type VotePageTemplateData struct {
-		TitleOrSomething string
-		Images           []string
+		PageData
+		// Candidates includes the eliminated ones, which are shown greyed out
+		Candidates []database.Candidate
+		Round      int
+		Rounds     int
+		FinalRound bool
+		NextChange time.Time
+		Remaining  time.Duration
+	}
+
+	type ResultsPageTemplateData struct {
+		PageData
+		EndTime time.Time
+		Results database.Results
+		// Candidates looks up each candidate in the results by ID
+		Candidates map[string]database.Candidate
 	}
 
-	switch phase := sched.GetPhase(); phase {
-	case scheduler.Before:
-		return ServeSingleFileHandler("vote_before.html")
-	case scheduler.After:
-		return ServeSingleFileHandler("vote_after.html")
-	case scheduler.During:
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := current()
+		sched := settings.sched
+		startTime, endTime := settings.conf.StartTime, settings.conf.EndTime
+		page := newPageData(r, settings.conf)
 
-			// I don't like that the template is read and parsed each time a
-			// request comes in, but I won't worry too much until we have performance issues
-			tmpl := template.Must(template.ParseFiles("public/vote_during.html"))
+		switch phase := sched.GetPhase(); phase {
+		case scheduler.Before:
+			data := BeforePageTemplateData{
+				PageData:  page,
+				StartTime: startTime,
+				Remaining: time.Until(startTime),
+			}
 
-			data := VotePageTemplateData{
-				TitleOrSomething: "Templates4Ever",
-				Images:           db.GetCandidateList(true),
+			if err := beforeTemplate.Execute(w, data); err != nil {
+				logging.FromContext(r.Context()).Error("Unable to render before page", "error", err)
+			}
+		case scheduler.After:
+			data := ResultsPageTemplateData{
+				PageData:   page,
+				EndTime:    endTime,
+				Results:    db.GetResults(),
+				Candidates: make(map[string]database.Candidate),
+			}
+			for _, can := range db.GetCandidates(true) {
+				data.Candidates[can.ID] = can
 			}
 
-			tmpl.Execute(w, data)
-		})
+			if err := resultsTemplate.Execute(w, data); err != nil {
+				logging.FromContext(r.Context()).Error("Unable to render results page", "error", err)
+			}
+		case scheduler.During:
+			next := sched.NextChange()
+			data := VotePageTemplateData{
+				PageData:   page,
+				Candidates: db.GetCandidates(true),
+				Round:      sched.GetRound() + 1,
+				Rounds:     sched.GetTotalRounds(),
+				FinalRound: sched.GetRound()+1 == sched.GetTotalRounds(),
+				NextChange: next,
+				Remaining:  time.Until(next),
+			}
 
-	}
-	return http.NotFoundHandler()
+			if err := voteTemplate.Execute(w, data); err != nil {
+				logging.FromContext(r.Context()).Error("Unable to render vote page", "error", err)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
 }
 
 /***** GLOBAL VARIABLES *****/
 
+// sessionMaxAge is how long a voter stays logged in
+const sessionMaxAge = 7 * 24 * time.Hour
+
 var db *database.Store
+var sessions *auth.Sessions
+var stats *metrics.Metrics
+var publicFiles fs.FS
+var locales *i18n.Bundle
+var beforeTemplate *template.Template
+var voteTemplate *template.Template
+var resultsTemplate *template.Template
+var homeTemplate *template.Template
+var aboutTemplate *template.Template
+
+// announcer posts the battle's progress to Discord, it is nil when Discord.AnnounceChannel isn't set
+var announcer *discord.Bot
+
+// voting takes votes from Discord, it is nil unless Discord.Voting is on
+var voting *discord.Voting
 
-/***** MAIN *****/
+// crowner makes changes on Discord once there is a winner, it is nil unless Discord.Crown is on
+var crowner *discord.Crowner
 
-func main() {
+// weigher weights votes by the voter's roles on Discord, it is nil unless Discord.RoleWeights is set
+var weigher *discord.Weigher
 
-	configFile := "example_config.toml"
+// handlerSwitch passes requests on to the handler it was last Set to,
+// so the server can start listening before the router is built
+type handlerSwitch struct {
+	current atomic.Pointer[http.Handler]
+}
+
+// Set makes h the handler for every request from now on
+func (s *handlerSwitch) Set(h http.Handler) {
+	s.current.Store(&h)
+}
 
-	conf, err := config.LoadConfig(configFile)
+func (s *handlerSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.current.Load()).ServeHTTP(w, r)
+}
+
+// scheduleRunning is true while watchSchedule is following the schedule
+var scheduleRunning atomic.Bool
+
+/***** SERVE *****/
+
+// serve runs the web server until it is told to stop.
+// configFile is watched for changes, see reload.go.
+func serve(conf config.Config, configFile string) {
+	var err error
+
+	// The probes answer while everything else is set up, and say the server isn't ready until it is
+	checker := health.New()
+	endStartup := checker.BeginMaintenance("startup")
+	var templatesParsed atomic.Bool
+	checker.Add("templates", func() error {
+		if !templatesParsed.Load() {
+			return errors.New("page templates not parsed")
+		}
+		return nil
+	})
+
+	probes := http.NewServeMux()
+	probes.Handle("/healthz", checker.LiveHandler())
+	probes.Handle("/readyz", checker.ReadyHandler())
+	probes.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "starting up", http.StatusServiceUnavailable)
+	}))
+	handler := &handlerSwitch{}
+	handler.Set(probes)
+
+	// The config is validated to have both or neither
+	useTLS := conf.Server.TLSCertFile != ""
+
+	srv := &http.Server{
+		Handler:      handler,
+		Addr:         net.JoinHostPort(conf.Server.Address, strconv.Itoa(conf.Server.Port)),
+		WriteTimeout: conf.Server.WriteTimeout,
+		ReadTimeout:  conf.Server.ReadTimeout,
+		IdleTimeout:  conf.Server.IdleTimeout,
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
-		log.Fatal("Unable to load config")
+		log.Fatalf("Unable to listen on %s: %v", srv.Addr, err)
 	}
 
-	fmt.Printf("name: %s", conf.ElectionName)
+	serverErr := make(chan error, 1)
+	go func() {
+		if useTLS {
+			slog.Info("Listening", "url", "https://"+srv.Addr)
+			serverErr <- srv.ServeTLS(ln, conf.Server.TLSCertFile, conf.Server.TLSKeyFile)
+		} else {
+			slog.Info("Listening", "url", "http://"+srv.Addr)
+			serverErr <- srv.Serve(ln)
+		}
+	}()
 
-	resetDatabaseEachOpen := true
+	db, err = database.OpenDB(conf.DatabaseFile)
+	if err != nil {
+		log.Fatalf("Unable to open database (create one with the init command): %v", err)
+	}
+	defer db.Close()
 
-	if resetDatabaseEachOpen {
-		db, err = database.CreateOrOverwriteDB(conf.DatabaseFile)
-	} else {
-		db, err = database.OpenDB(conf.DatabaseFile)
+	endMigration := checker.BeginMaintenance("migration")
+	created, err := db.Migrate()
+	endMigration()
+	if err != nil {
+		log.Fatalf("Unable to migrate database: %v", err)
 	}
+	if len(created) > 0 {
+		slog.Info("Migrated database made by an older version", "created", created)
+	}
+	checker.Add("database", db.Verify)
+
+	sessions, err = auth.NewSessions(conf.SessionKeys, sessionMaxAge)
 	if err != nil {
-		panic(err) // could not open database. Unrecoverable error
+		log.Fatalf("Unable to set up sessions: %v", err)
 	}
-	defer db.Close()
+	sessions.Secure = conf.Server.TLSCertFile != ""
+
+	// A new database is filled from the manifest, if there is one
+	if len(db.GetCandidateList(true)) == 0 && conf.CandidatesFile != "" {
+		candidates, err := manifest.Load(conf.CandidatesFile, conf.ImageDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := db.InitializeCandidates(candidates); err != nil {
+			log.Fatalf("Unable to add candidates: %v", err)
+		}
+		slog.Info("Added candidates from manifest", "file", conf.CandidatesFile, "candidates", len(candidates))
+	}
+
+	numberOfCandidates := len(db.GetCandidateList(true))
+	if numberOfCandidates < 2 {
+		log.Fatalf("There are %d candidates, at least 2 are needed. Add them with the candidates add command", numberOfCandidates)
+	}
+
+	// One candidate is eliminated each round until only the winner is left
+	rounds := numberOfCandidates - 1
+	settings, err := newLiveSettings(conf, rounds, nil)
+	if err != nil {
+		log.Fatalf("Unable to set up trusted proxies: %v", err)
+	}
+	live.Store(settings)
+
+	publicFiles, err = newPublicFS(conf.PublicDir)
+	if err != nil {
+		log.Fatalf("Unable to use PublicDir %s: %v", conf.PublicDir, err)
+	}
+
+	locales, err = i18n.Load()
+	if err != nil {
+		log.Fatalf("Unable to load translations: %v", err)
+	}
+
+	// language.html holds the parts every page shares
+	beforeTemplate, err = template.ParseFS(publicFiles, "vote_before.html", "language.html")
+	if err != nil {
+		log.Fatalf("Unable to parse before page template: %v", err)
+	}
+	voteTemplate, err = template.ParseFS(publicFiles, "vote_during.html", "language.html")
+	if err != nil {
+		log.Fatalf("Unable to parse vote page template: %v", err)
+	}
+	resultsTemplate, err = template.ParseFS(publicFiles, "vote_after.html", "language.html")
+	if err != nil {
+		log.Fatalf("Unable to parse results page template: %v", err)
+	}
+	homeTemplate, err = template.ParseFS(publicFiles, "home.html", "language.html")
+	if err != nil {
+		log.Fatalf("Unable to parse home page template: %v", err)
+	}
+	aboutTemplate, err = template.ParseFS(publicFiles, "about.html", "language.html")
+	if err != nil {
+		log.Fatalf("Unable to parse about page template: %v", err)
+	}
+	templatesParsed.Store(true)
 
-	// FILL DATABASE WITH DUMMY DATA FOR TESTING
-	db.InitializeCandidates([]string{"jeb", "steve", "francis"})
-	numberOfCandidates := 3
+	checker.Add("scheduler", func() error {
+		// Once the battle is over there is nothing left for the scheduler to do
+		if !scheduleRunning.Load() && current().sched.GetPhase() != scheduler.After {
+			return errors.New("scheduler is not running")
+		}
+		return nil
+	})
+
+	stats = metrics.New(metrics.Sources{
+		Votes: func() map[string]int { return db.GetVotes() },
+		Phase: func() int { return int(current().sched.GetPhase()) },
+		Round: func() int { return current().sched.GetRound() },
+	})
+	db.SetObserver(stats.ObserveDB)
 
-	sched := scheduler.CreateSchedule(conf.StartTime, conf.EndTime, numberOfCandidates)
+	// The announcements, voting, crowning and role weights share one connection to Discord
+	if conf.Discord.AnnounceChannel != "" || conf.Discord.Voting || conf.Discord.Crown || len(conf.Discord.RoleWeights) > 0 {
+		session, err := discord.NewSession(conf)
+		if err != nil {
+			log.Fatalf("Unable to set up the Discord bot: %v", err)
+		}
+
+		if conf.Discord.AnnounceChannel != "" {
+			announcer = discord.NewBot(session, conf)
+			slog.Info("Announcing the battle on Discord", "channel", conf.Discord.AnnounceChannel)
+		}
+		if conf.Discord.Voting {
+			voting = discord.NewVoting(session, conf, db, discordVote)
+			if err := voting.Open(); err != nil {
+				log.Fatal(err)
+			}
+			defer voting.Close()
+			slog.Info("Taking votes from Discord", "guild", conf.GuildID)
+		}
+		if conf.Discord.Crown {
+			crowner = discord.NewCrowner(session, conf)
+		}
+		if len(conf.Discord.RoleWeights) > 0 {
+			weigher = discord.NewWeigher(session, conf)
+			slog.Info("Weighting votes by Discord role", "roles", len(conf.Discord.RoleWeights))
+		}
+	}
 
 	r := mux.NewRouter()
-	r.Handle("/about", ServeSingleFileHandler("about.html")).Methods("GET")
-	r.Handle("/vote", VoteGETHandler(sched)).Methods("GET")
-	r.PathPrefix("/res/").Handler(http.StripPrefix("/res/", http.FileServer(http.Dir("public/res"))))
-	r.Handle("/", ServeSingleFileHandler("home.html")).Methods("GET")
-	r.Handle("/vote", http.HandlerFunc(VotePOSTHandler)).Methods("POST")
+	votePage := VoteGETHandler()
+	homePage := PageHandler(homeTemplate)
 
-	port := "8080"
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         "127.0.0.1:" + port,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+	switch conf.LoginMode {
+	case "token":
+		r.Handle("/login/link", sessions.LinkHandler(db, locales)).Methods("GET")
+		if conf.TokenOnFirstVisit {
+			votePage = sessions.IssueOnFirstVisit(votePage, locales)
+			homePage = sessions.IssueOnFirstVisit(homePage, locales)
+		}
+	case "discord", "":
+		login := auth.NewDiscordLogin(conf, sessions, locales)
+		r.Handle("/login", login.LoginHandler()).Methods("GET")
+		r.Handle("/login/callback", login.CallbackHandler()).Methods("GET")
+		r.Handle("/logout", login.LogoutHandler()).Methods("GET")
+	default:
+		log.Fatalf("Unknown LoginMode %q", conf.LoginMode)
 	}
 
-	log.Print("Listening on port " + port + " ... ")
-	log.Fatal(srv.ListenAndServe())
+	r.Handle("/about", PageHandler(aboutTemplate)).Methods("GET")
+	r.Handle("/lang", locales.SetHandler()).Methods("GET")
+	r.Handle("/vote", votePage).Methods("GET")
+	r.PathPrefix("/res/").Handler(http.StripPrefix("/res/", ResourceHandler(publicFiles)))
+	r.PathPrefix("/img/").Handler(http.StripPrefix("/img/", ImageHandler(os.DirFS(conf.ImageDir))))
+	r.Handle("/", homePage).Methods("GET")
+	r.Handle("/vote", RateLimitHandler(http.HandlerFunc(VotePOSTHandler))).Methods("POST")
+	r.Handle("/metrics", stats.Handler()).Methods("GET")
+	r.Handle("/healthz", checker.LiveHandler()).Methods("GET")
+	r.Handle("/readyz", checker.ReadyHandler()).Methods("GET")
+	instrumentRouter(r)
+	handler.Set(r)
+	endStartup()
+
+	// ctx is cancelled on Ctrl-C or when a process supervisor asks us to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The schedule is followed again from the start whenever a reload changes it
+	scheduleChanged := make(chan struct{}, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		watchSchedule(ctx, scheduleChanged)
+	}()
+	go func() {
+		defer wg.Done()
+		watchConfig(ctx, configFile, func() {
+			if reloadConfig(rounds) {
+				select {
+				case scheduleChanged <- struct{}{}:
+				default:
+				}
+			}
+		})
+	}()
+
+	select {
+	case err := <-serverErr:
+		slog.Error("Server stopped", "error", err)
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	}
+	stop() // a second Ctrl-C now kills the process immediately
+
+	// Stop accepting connections and wait for in-flight requests to finish.
+	// Votes are written to the database before their request returns,
+	// so once this is done there is nothing left to flush.
+	shutdownTimeout := current().conf.ShutdownTimeout
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Requests still running, closing anyway", "timeout", shutdownTimeout.String(), "error", err)
+	}
+
+	wg.Wait()
+	// db.Close() runs from the defer above
+}
+
+// watchSchedule logs each change in the battle and runs the eliminations,
+// until the battle ends or ctx is cancelled. A message on changed means the
+// schedule was reloaded, and it is followed from the new one.
+func watchSchedule(ctx context.Context, changed <-chan struct{}) {
+	scheduleRunning.Store(true)
+	defer scheduleRunning.Store(false)
+
+	for {
+		sched := current().sched
+
+		// Catch up on any rounds which ended while the server was down, or earlier in the new schedule
+		eliminateDue(sched)
+
+		subCtx, cancel := context.WithCancel(ctx)
+		over := followSchedule(subCtx, sched, changed)
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+		// A reload could still move the end of the battle into the future
+		if over {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changed:
+			}
+		}
+		slog.Info("Following the new schedule", "start", current().conf.StartTime, "end", current().conf.EndTime)
+	}
+}
+
+// followSchedule handles the events of one schedule. It returns true once the battle is over,
+// or false if the schedule changed or ctx was cancelled.
+func followSchedule(ctx context.Context, sched scheduler.Schedule, changed <-chan struct{}) bool {
+	events := sched.Subscribe(ctx)
+	for {
+		select {
+		case <-changed:
+			return false
+		case change, ok := <-events:
+			if !ok {
+				return false
+			}
+			if !change {
+				stats.SchedulerEvent("end")
+				eliminateDue(sched)
+				slog.Info("The battle is over", "winner", db.GetResults().Winner)
+				return true
+			}
+			if round := sched.GetRound(); round == 0 {
+				stats.SchedulerEvent("start")
+				slog.Info("The battle has started")
+				announce("start", func(ctx context.Context, bot *discord.Bot) error {
+					conf := current().conf
+					return bot.AnnounceStart(ctx, conf.ElectionName, db.GetCandidates(false), conf.EndTime)
+				})
+				if voting != nil && current().conf.Discord.AnnounceChannel != "" {
+					ctx, cancel := context.WithTimeout(ctx, time.Minute)
+					if err := voting.PostBallots(ctx, db.GetCandidates(false)); err != nil {
+						slog.Error("Unable to post the Discord ballots", "error", err)
+					}
+					cancel()
+				}
+			} else {
+				stats.SchedulerEvent("elimination")
+				eliminateDue(sched)
+			}
+		}
+	}
+}
+
+// eliminateDue eliminates a candidate for every round the schedule says has ended
+// but which isn't in the elimination history yet
+func eliminateDue(sched scheduler.Schedule) {
+	eliminated := false
+	for round := len(db.GetEliminations()) + 1; round <= sched.GetRound(); round++ {
+		e, err := db.EliminateLowest(round)
+		if errors.Is(err, database.ErrLastCandidate) {
+			// Candidates eliminated by hand mean the winner can be decided early
+			break
+		}
+		if err != nil {
+			slog.Error("Unable to eliminate candidate", "round", round, "error", err)
+			break
+		}
+		slog.Info("Eliminated candidate", "round", round, "candidate", e.Candidate, "votes", e.Totals[e.Candidate])
+		announce("elimination", func(ctx context.Context, bot *discord.Bot) error {
+			return bot.AnnounceElimination(ctx, e, db.GetResults(), db.GetCandidates(true))
+		})
+		eliminated = true
+	}
+
+	// The winner is crowned by the last elimination rather than the end of the schedule,
+	// which is seen again every time the server restarts
+	if results := db.GetResults(); eliminated && results.Winner != "" {
+		announce("winner", func(ctx context.Context, bot *discord.Bot) error {
+			return bot.AnnounceWinner(ctx, current().conf.ElectionName, results, db.GetCandidates(true))
+		})
+		crownWinner(results)
+	}
+}
+
+// crownWinner runs the actions for the winner on Discord, if they are turned on.
+// Each action is tried even if an earlier one failed.
+func crownWinner(results database.Results) {
+	if crowner == nil {
+		return
+	}
+	conf := current().conf
+	actions := crowner.Plan(conf.ElectionName, results, db.GetCandidates(true), db.GetAllTransactions())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	for _, a := range actions {
+		if conf.Discord.CrownDryRun {
+			slog.Info("Crowning dry run", "action", a.Description)
+			continue
+		}
+		if err := a.Run(ctx); err != nil {
+			slog.Error("Unable to crown the winner", "action", a.Description, "error", err)
+			continue
+		}
+		slog.Info("Crowned the winner", "action", a.Description)
+	}
+}
+
+// announce posts to Discord with the bot, if there is one. Failures are only logged,
+// the battle carries on without Discord.
+func announce(what string, post func(ctx context.Context, bot *discord.Bot) error) {
+	if announcer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := post(ctx, announcer); err != nil {
+		slog.Error("Unable to announce on Discord", "announcement", what, "error", err)
+	}
 }
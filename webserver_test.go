@@ -0,0 +1,342 @@
+package main
+
+import (
+	"Emoji-battle-royale/auth"
+	"Emoji-battle-royale/config"
+	"Emoji-battle-royale/database"
+	"Emoji-battle-royale/discord"
+	"Emoji-battle-royale/i18n"
+	"Emoji-battle-royale/metrics"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// setupServer sets the globals the vote handlers use, with the rate limits in limits.
+// Voting is open for the hour either side of now.
+func setupServer(t *testing.T, limits config.RateLimitConfig) {
+	var err error
+	if locales, err = i18n.Load(); err != nil {
+		t.Fatalf("Couldn't load locales: %v", err)
+	}
+	if sessions, err = auth.NewSessions([]string{"0123456789abcdef"}, time.Hour); err != nil {
+		t.Fatalf("Couldn't create sessions: %v", err)
+	}
+	stats = metrics.New(metrics.Sources{
+		Votes: func() map[string]int { return nil },
+		Phase: func() int { return 1 },
+		Round: func() int { return 0 },
+	})
+
+	setupPhase(t, limits, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// setupPhase replaces the live settings with a battle running from start to end
+func setupPhase(t *testing.T, limits config.RateLimitConfig, start, end time.Time) {
+	conf := config.Config{RateLimit: limits, StartTime: start, EndTime: end}
+	s, err := newLiveSettings(conf, 1, nil)
+	if err != nil {
+		t.Fatalf("Couldn't create settings: %v", err)
+	}
+	live.Store(s)
+}
+
+// voteRequest is a POST to /vote from userID, or without a session if userID is empty
+func voteRequest(userID string, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/vote", strings.NewReader(body))
+	if userID != "" {
+		rec := httptest.NewRecorder()
+		sessions.SetUser(rec, req, userID)
+		for _, c := range rec.Result().Cookies() {
+			req.AddCookie(c)
+		}
+	}
+	return req
+}
+
+// scrape returns the metrics as served on /metrics
+func scrape() string {
+	rec := httptest.NewRecorder()
+	stats.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	/* each row takes the form:
+	{limits, voters taking turns, requests, requests let through, Retry-After, throttled counter}
+	*/
+	testData := []struct {
+		limits     config.RateLimitConfig
+		voters     []string
+		requests   int
+		allowed    int
+		retryAfter string
+		counter    string
+	}{
+		{config.RateLimitConfig{VoterRate: 1, VoterBurst: 3}, []string{"jonny"}, 5, 3, "1", `ebr_votes_rejected_total{reason="throttled_voter"} 2`},
+		{config.RateLimitConfig{VoterRate: 0.25, VoterBurst: 1}, []string{"jonny"}, 2, 1, "4", `ebr_votes_rejected_total{reason="throttled_voter"} 1`},
+		{config.RateLimitConfig{IPRate: 0.5, IPBurst: 2}, []string{"jonny", "billy", "sally"}, 3, 2, "2", `ebr_votes_rejected_total{reason="throttled_ip"} 1`},
+		// Each voter has their own bucket, but they share the IP's
+		{config.RateLimitConfig{VoterRate: 1, VoterBurst: 1, IPRate: 1, IPBurst: 10}, []string{"jonny", "billy"}, 2, 2, "", ""},
+		{config.RateLimitConfig{VoterRate: 1, VoterBurst: 5, IPRate: 1, IPBurst: 2}, []string{"jonny"}, 3, 2, "1", `ebr_votes_rejected_total{reason="throttled_ip"} 1`},
+	}
+
+	for i, d := range testData {
+		setupServer(t, d.limits)
+		handler := RateLimitHandler(ok)
+
+		allowed := 0
+		var throttled *httptest.ResponseRecorder
+		for n := 0; n < d.requests; n++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, voteRequest(d.voters[n%len(d.voters)], "{}"))
+			switch rec.Code {
+			case http.StatusOK:
+				allowed++
+			case http.StatusTooManyRequests:
+				throttled = rec
+			default:
+				t.Errorf("Test[%d] unexpected status %d", i, rec.Code)
+			}
+		}
+
+		if allowed != d.allowed {
+			t.Errorf("Test[%d] expected %d requests let through, got %d", i, d.allowed, allowed)
+		}
+		if d.retryAfter == "" {
+			if throttled != nil {
+				t.Errorf("Test[%d] expected nothing to be throttled", i)
+			}
+			continue
+		}
+		if throttled == nil {
+			t.Errorf("Test[%d] expected a 429", i)
+			continue
+		}
+		if got := throttled.Header().Get("Retry-After"); got != d.retryAfter {
+			t.Errorf("Test[%d] expected Retry-After %s, got %q", i, d.retryAfter, got)
+		}
+		if !strings.Contains(throttled.Body.String(), `"Code":"too_many_requests"`) {
+			t.Errorf("Test[%d] unexpected body %s", i, throttled.Body.String())
+		}
+		if metrics := scrape(); !strings.Contains(metrics, d.counter+"\n") {
+			t.Errorf("Test[%d] expected the metrics to contain %q", i, d.counter)
+		}
+	}
+}
+
+func TestVoteLimits(t *testing.T) {
+	setupServer(t, config.RateLimitConfig{MaxVotesPerCandidate: 10, MaxVotesPerTransaction: 15})
+
+	store, err := database.CreateOrOverwriteDB(filepath.Join(t.TempDir(), "votes.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer store.Close()
+	store.InitializeCandidates([]database.Candidate{{ID: "ted", Active: true}, {ID: "jeb", Active: true}})
+	db = store
+
+	/* each row takes the form:
+	{body, status, candidate blamed}
+	*/
+	testData := []struct {
+		body      string
+		status    int
+		candidate string
+	}{
+		{`{"Votes": {"ted": 10, "jeb": 5}}`, http.StatusOK, ""},
+		{`{"Votes": {"ted": 11}}`, http.StatusUnprocessableEntity, "ted"},
+		{`{"Votes": {"ted": 2000000000}}`, http.StatusUnprocessableEntity, "ted"},
+		{`{"Votes": {"jeb": 6, "ted": 10}}`, http.StatusUnprocessableEntity, "ted"},
+		{`{"Votes": {"ted": -1}}`, http.StatusUnprocessableEntity, "ted"},
+		// The client can't give itself a weight either
+		{`{"Votes": {"ted": 1}, "Weight": 1000000}`, http.StatusOK, ""},
+		{`{"Votes": {"ted": 0}}`, http.StatusUnprocessableEntity, "ted"},
+		{`{"Votes": {}}`, http.StatusUnprocessableEntity, ""},
+		{`{"Votes": {"ted": 1, "jeb": 1, "hil": 1}}`, http.StatusUnprocessableEntity, ""},
+		{`{"Votes": {"ted": 1, "` + strings.Repeat("x", maxVoteBody) + `": 1}}`, http.StatusBadRequest, ""},
+	}
+
+	for i, d := range testData {
+		rec := httptest.NewRecorder()
+		VotePOSTHandler(rec, voteRequest("jonny", d.body))
+		if rec.Code != d.status {
+			t.Errorf("Test[%d] expected status %d, got %d: %s", i, d.status, rec.Code, rec.Body.String())
+		}
+		if d.candidate != "" && !strings.Contains(rec.Body.String(), `"Candidate":"`+d.candidate+`"`) {
+			t.Errorf("Test[%d] expected %s to be blamed, got %s", i, d.candidate, rec.Body.String())
+		}
+	}
+
+	if votes := store.GetVotes(); votes["ted"] != 11 || votes["jeb"] != 5 {
+		t.Errorf("Expected only the accepted votes to count, got %v", votes)
+	}
+	if metrics := scrape(); !strings.Contains(metrics, `ebr_votes_rejected_total{reason="invalid_count"} 7`+"\n") {
+		t.Errorf("Expected 7 votes rejected for their count")
+	}
+	if results := store.GetResults(); results.Transactions != 2 {
+		t.Errorf("Expected only the accepted votes to be stored, got %d transactions", results.Transactions)
+	}
+}
+
+func TestVoteClosed(t *testing.T) {
+	limits := config.RateLimitConfig{MaxVotesPerCandidate: 100, MaxVotesPerTransaction: 200}
+	setupServer(t, limits)
+	store, err := database.CreateOrOverwriteDB(filepath.Join(t.TempDir(), "votes.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	defer store.Close()
+	store.InitializeCandidates([]database.Candidate{{ID: "steve", Active: true}, {ID: "jeb", Active: true}})
+	db = store
+
+	/* each row takes the form:
+	{start, end, status}
+	*/
+	now := time.Now()
+	testData := []struct {
+		start, end time.Time
+		status     int
+	}{
+		{now.Add(time.Hour), now.Add(2 * time.Hour), http.StatusForbidden},
+		{now.Add(-time.Hour), now.Add(time.Hour), http.StatusOK},
+		{now.Add(-2 * time.Hour), now.Add(-time.Hour), http.StatusForbidden},
+	}
+
+	for i, d := range testData {
+		setupPhase(t, limits, d.start, d.end)
+		rec := httptest.NewRecorder()
+		VotePOSTHandler(rec, voteRequest("jonny", `{"Votes": {"steve": 50}}`))
+		if rec.Code != d.status {
+			t.Errorf("Test[%d] expected status %d, got %d: %s", i, d.status, rec.Code, rec.Body.String())
+		}
+		if d.status == http.StatusForbidden && !strings.Contains(rec.Body.String(), `"Code":"closed"`) {
+			t.Errorf("Test[%d] unexpected body %s", i, rec.Body.String())
+		}
+
+		// Votes from Discord follow the same rule
+		err := discordVote("80351110224678912", "steve")
+		if closed := errors.Is(err, discord.ErrVotingClosed); closed != (d.status == http.StatusForbidden) {
+			t.Errorf("Test[%d] unexpected result of a Discord vote: %v", i, err)
+		}
+	}
+
+	if votes := store.GetVotes(); votes["steve"] != 51 {
+		t.Errorf("Expected only the votes while open to count, got %v", votes)
+	}
+	if metrics := scrape(); !strings.Contains(metrics, `ebr_votes_rejected_total{reason="closed"} 4`+"\n") {
+		t.Errorf("Expected 4 votes rejected as closed")
+	}
+}
+
+func TestPageHandler(t *testing.T) {
+	setupServer(t, config.RateLimitConfig{})
+	fsys, err := newPublicFS("")
+	if err != nil {
+		t.Fatalf("Couldn't create public FS: %v", err)
+	}
+
+	/* each row takes the form:
+	{page, text expected in French}
+	*/
+	testData := []struct {
+		page string
+		text string
+	}{
+		{"home.html", "Bienvenue dans la bataille"},
+		{"about.html", "celui qui a le moins de votes est éliminé"},
+	}
+
+	for i, d := range testData {
+		tmpl, err := template.ParseFS(fsys, d.page, "language.html")
+		if err != nil {
+			t.Fatalf("Test[%d] couldn't parse %s: %v", i, d.page, err)
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", "fr")
+		PageHandler(tmpl).ServeHTTP(rec, req)
+
+		body := rec.Body.String()
+		if !strings.Contains(body, `<html lang="fr">`) || !strings.Contains(body, d.text) {
+			t.Errorf("Test[%d] expected %s in French, got %s", i, d.page, body)
+		}
+	}
+}
+
+func TestHomeLoginLink(t *testing.T) {
+	setupServer(t, config.RateLimitConfig{})
+	fsys, _ := newPublicFS("")
+	tmpl, err := template.ParseFS(fsys, "home.html", "language.html")
+	if err != nil {
+		t.Fatalf("Couldn't parse home page: %v", err)
+	}
+
+	/* each row takes the form:
+	{LoginMode, login link shown}
+	*/
+	testData := []struct {
+		mode string
+		link bool
+	}{
+		{"", true},
+		{"discord", true},
+		{"token", false},
+	}
+
+	for i, d := range testData {
+		s, _ := newLiveSettings(config.Config{LoginMode: d.mode}, 1, nil)
+		live.Store(s)
+
+		rec := httptest.NewRecorder()
+		PageHandler(tmpl).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if link := strings.Contains(rec.Body.String(), `href="login"`); link != d.link {
+			t.Errorf("Test[%d] expected the login link shown %v, got %v", i, d.link, link)
+		}
+	}
+}
+
+func TestInstrumentRouter(t *testing.T) {
+	setupServer(t, config.RateLimitConfig{})
+	r := mux.NewRouter()
+	r.Handle("/about", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).Methods("GET")
+	instrumentRouter(r)
+
+	/* each row takes the form:
+	{method, path, status, counter}
+	*/
+	testData := []struct {
+		method, path string
+		status       int
+		counter      string
+	}{
+		{"GET", "/about", http.StatusOK, `ebr_http_requests_total{code="200",method="GET",route="/about"} 1`},
+		{"GET", "/missing", http.StatusNotFound, `ebr_http_requests_total{code="404",method="GET",route="unknown"} 1`},
+		{"POST", "/about", http.StatusMethodNotAllowed, `ebr_http_requests_total{code="405",method="POST",route="unknown"} 1`},
+	}
+
+	for i, d := range testData {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(d.method, d.path, nil))
+		if rec.Code != d.status {
+			t.Errorf("Test[%d] expected status %d, got %d", i, d.status, rec.Code)
+		}
+		if rec.Header().Get("X-Request-ID") == "" {
+			t.Errorf("Test[%d] expected a request ID", i)
+		}
+		if metrics := scrape(); !strings.Contains(metrics, d.counter+"\n") {
+			t.Errorf("Test[%d] expected the metrics to contain %q", i, d.counter)
+		}
+	}
+}